@@ -6,26 +6,62 @@ package lazymem_test
 
 import (
 	"context"
-	"reflect"
-	"runtime"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
 	"syscall"
 	"testing"
-	"unsafe"
 
 	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/internal/memfd"
 	"github.com/tsavola/lazymem/internal/tester"
 	"github.com/tsavola/lazymem/linear"
 )
 
-func BenchmarkSharedReadLazymem(b *testing.B)  { benchmarkSharedLazymem(b, "BenchmarkSharedRead") }
-func BenchmarkSharedReadMemfd(b *testing.B)    { benchmarkSharedMemfd(b, "BenchmarkSharedRead") }
-func BenchmarkSharedWriteLazymem(b *testing.B) { benchmarkSharedLazymem(b, "BenchmarkSharedWrite") }
-func BenchmarkSharedWriteMemfd(b *testing.B)   { benchmarkSharedMemfd(b, "BenchmarkSharedWrite") }
+func BenchmarkSharedReadLazymem(b *testing.B) {
+	benchmarkSharedLazymem(b, "BenchmarkSharedRead", nil)
+}
+
+func BenchmarkSharedReadLazymemMaxRead(b *testing.B) {
+	benchmarkSharedLazymem(b, "BenchmarkSharedRead", func(c *lazymem.Config) {
+		c.MaxRead = 32768
+	})
+}
+
+func BenchmarkSharedReadLazymemMaxReadahead(b *testing.B) {
+	benchmarkSharedLazymem(b, "BenchmarkSharedRead", func(c *lazymem.Config) {
+		c.MaxReadahead = 131072
+	})
+}
+
+func BenchmarkSharedReadMemfd(b *testing.B) {
+	benchmarkSharedMemfd(b, "BenchmarkSharedRead")
+}
+
+func BenchmarkSharedWriteLazymem(b *testing.B) {
+	benchmarkSharedLazymem(b, "BenchmarkSharedWrite", nil)
+}
+
+func BenchmarkSharedWriteLazymemNoWriteback(b *testing.B) {
+	benchmarkSharedLazymem(b, "BenchmarkSharedWrite", func(c *lazymem.Config) {
+		c.DisableWritebackCaching = true
+	})
+}
 
-func benchmarkSharedLazymem(b *testing.B, name string) {
+func BenchmarkSharedWriteMemfd(b *testing.B) {
+	benchmarkSharedMemfd(b, "BenchmarkSharedWrite")
+}
+
+func benchmarkSharedLazymem(b *testing.B, name string, configure func(*lazymem.Config)) {
 	ctx := context.Background()
 
-	mm, err := lazymem.New(ctx, newConfig(b, false))
+	config := newConfig(b, false)
+	if configure != nil {
+		configure(config)
+	}
+
+	mm, err := lazymem.New(ctx, config)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -53,24 +89,131 @@ func benchmarkSharedLazymem(b *testing.B, name string) {
 func benchmarkSharedMemfd(b *testing.B, name string) {
 	data := make([]byte, tester.BenchmarkSize)
 
-	nameBuf := []byte{0}
-	namePtr := (*reflect.StringHeader)(unsafe.Pointer(&nameBuf)).Data
-
 	for i := 0; i < b.N; i++ {
 		func() {
-			fd, _, errno := syscall.Syscall(319, namePtr, 1, 0)
-			if errno != 0 {
-				b.Fatal(errno)
+			fd, err := memfd.Create("", memfd.CLOEXEC)
+			if err != nil {
+				b.Fatal(err)
 			}
-			defer syscall.Close(int(fd))
+			defer syscall.Close(fd)
 
-			if _, err := syscall.Write(int(fd), data); err != nil {
+			if _, err := syscall.Write(fd, data); err != nil {
 				b.Fatal(err)
 			}
 
-			runTester(b, name, int(fd))
+			runTester(b, name, fd)
 		}()
 	}
+}
+
+// BenchmarkParallelFault faults in a buffer from multiple threads of a
+// consumer process.
+func BenchmarkParallelFault(b *testing.B) {
+	for _, threads := range []int{1, 4, 16, 64} {
+		b.Run(strconv.Itoa(threads), func(b *testing.B) {
+			benchmarkParallelFault(b, threads)
+		})
+	}
+}
+
+func benchmarkParallelFault(b *testing.B, threads int) {
+	ctx := context.Background()
+
+	mm, err := lazymem.New(ctx, newConfig(b, false))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mm.Shutdown(ctx)
+
+	data := make([]byte, tester.BenchmarkSize)
+
+	for i := 0; i < b.N; i++ {
+		func() {
+			buf := linear.NewBuffer(data)
+			buf.BlocksPopulated(0, len(data)/linear.BlockSize)
+			buf.PopulationFinished()
+
+			fd, err := mm.CreateCloned(tester.BenchmarkSize, syscall.O_RDONLY, buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer syscall.Close(fd)
+
+			runTester(b, "BenchmarkParallelFault", fd, strconv.Itoa(threads))
+		}()
+	}
+}
+
+// BenchmarkMultiProcessFault faults in separate buffers from multiple
+// consumer processes at the same time.
+func BenchmarkMultiProcessFault(b *testing.B) {
+	testerBin := buildTester(b)
+
+	for _, procs := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(procs), func(b *testing.B) {
+			benchmarkMultiProcessFault(b, testerBin, procs)
+		})
+	}
+}
+
+// buildTester once, so that the benchmark doesn't measure compilation.
+func buildTester(b *testing.B) (filename string) {
+	filename = path.Join(b.TempDir(), "tester")
+
+	if out, err := exec.Command(goBin, "build", "-o", filename, "internal/runtester.go").CombinedOutput(); err != nil {
+		b.Fatalf("%v: %s", err, out)
+	}
+	return
+}
+
+func benchmarkMultiProcessFault(b *testing.B, testerBin string, procs int) {
+	ctx := context.Background()
+
+	mm, err := lazymem.New(ctx, newConfig(b, false))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mm.Shutdown(ctx)
+
+	const size = tester.BenchmarkSize / 16
+
+	data := make([]byte, size)
+
+	for i := 0; i < b.N; i++ {
+		fds := make([]int, procs)
+
+		for j := range fds {
+			buf := linear.NewBuffer(data)
+			buf.BlocksPopulated(0, len(data)/linear.BlockSize)
+			buf.PopulationFinished()
+
+			fds[j], err = mm.CreateCloned(size, syscall.O_RDONLY, buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		var wg sync.WaitGroup
+
+		errs := make([]error, procs)
+
+		for j, fd := range fds {
+			wg.Add(1)
+			go func(j, fd int) {
+				defer wg.Done()
+				defer syscall.Close(fd)
+				errs[j] = spawnTester(testerBin, []string{testerBin, "BenchmarkParallelFault", "1", strconv.Itoa(size)}, fd)
+			}(j, fd)
+		}
+
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
 
-	runtime.KeepAlive(nameBuf)
+	b.SetBytes(int64(procs) * size)
 }
@@ -5,9 +5,12 @@
 package lazymem
 
 import (
+	"context"
 	"io"
 	"path"
 	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
 )
 
 // TemporalBuffer's content will be read at most once (per range).
@@ -29,43 +32,214 @@ type SharedBuffer interface {
 	io.Closer
 }
 
+// contextReader is implemented by linear.Buffer and sparse.Buffer, so that
+// their waits are traced as part of the read op, and can be interrupted when
+// the filesystem fails.
+type contextReader interface {
+	ReadAtContext(ctx context.Context, target []byte, sourceOffset int64) (int, error)
+}
+
+type bufferKind int
+
+const (
+	kindShared bufferKind = iota
+	kindCloned
+	kindTemporal
+)
+
+func (k bufferKind) String() string {
+	switch k {
+	case kindShared:
+		return "shared"
+	case kindCloned:
+		return "cloned"
+	case kindTemporal:
+		return "temporal"
+	default:
+		return "unknown"
+	}
+}
+
 type buffer struct {
+	kind    bufferKind
 	size    int64
-	readAt  func(target []byte, sourceOffset int64) (n int, err error)
+	readAt  func(ctx context.Context, target []byte, sourceOffset int64) (n int, err error)
 	writeAt func(source []byte, targetOffset int64) (n int, err error)
 	close   func() error
+	hooks   LifecycleBuffer
+	promo   *promotion
+	view    bool // doesn't have its own memory
+}
+
+func (b *buffer) pages() uint64 {
+	if b.view {
+		return 0
+	}
+	return countPages(b.size)
+}
+
+func newBuffer(kind bufferKind, size int64, r io.ReaderAt, writeAt func([]byte, int64) (int, error), close func() error) (b buffer) {
+	b = buffer{
+		kind:    kind,
+		size:    size,
+		writeAt: writeAt,
+		close:   close,
+	}
+
+	if c, ok := r.(contextReader); ok {
+		b.readAt = c.ReadAtContext
+	} else {
+		b.readAt = func(_ context.Context, target []byte, sourceOffset int64) (int, error) {
+			return r.ReadAt(target, sourceOffset)
+		}
+	}
+
+	if h, ok := r.(LifecycleBuffer); ok {
+		b.hooks = h
+	}
+	return
 }
 
 // Create a file descriptor which should be passed to another process for
 // memory mapping.  The memory can be mapped multiple times as PROT_SHARED
-// and/or PROT_PRIVATE.
+// and/or PROT_PRIVATE.  Package handoff can be used to pass the file
+// descriptors of all buffer kinds.
 //
 // In case of failure, no SharedBuffer methods have been invoked.
 func (m *Manager) Create(size int64, mode int, b SharedBuffer) (fd int, err error) {
-	return m.create(buffer{size, b.ReadAt, b.WriteAt, b.Close}, mode)
+	return m.create(newBuffer(kindShared, size, b, b.WriteAt, b.Close), mode)
 }
 
 // CreateCloned memory file descriptor which should be passed to another
 // process for mapping.  The memory can be mapped multiple times as
 // PROT_PRIVATE.
 //
+// If Config.PromoteCloned is set and the ClonedBuffer is also a
+// PopulatedBuffer, the content is copied to a sealed memory file once it has
+// been fully populated.  Reopen returns the memory file after that.
+//
 // In case of failure, no ClonedBuffer methods have been invoked.
 func (m *Manager) CreateCloned(size int64, mode int, b ClonedBuffer) (fd int, err error) {
-	return m.create(buffer{size, b.ReadAt, noWriteAt, b.Close}, mode)
+	buf := newBuffer(kindCloned, size, b, noWriteAt, b.Close)
+
+	if p, ok := b.(PopulatedBuffer); ok && m.PromoteCloned {
+		buf.promo = newPromotion(p)
+	}
+
+	return m.create(buf, mode)
 }
 
 // CreateTemporal memory file descriptor which should be passed to another
 // process for mapping.  The memory can be mapped once as PROT_PRIVATE.
 func (m *Manager) CreateTemporal(size int64, mode int, b TemporalBuffer) (fd int, err error) {
-	return m.create(buffer{size, b.ReadAt, noWriteAt, noClose}, mode)
+	return m.create(newBuffer(kindTemporal, size, b, noWriteAt, noClose), mode)
 }
 
 func (m *Manager) create(b buffer, mode int) (fd int, err error) {
-	id, name := m.fs.registerBuffer(b)
+	s, err := m.active()
+	if err != nil {
+		b.forget()
+		return
+	}
+
+	return m.createIn(s, b, mode)
+}
+
+func (m *Manager) createIn(s *session, b buffer, mode int) (fd int, err error) {
+	id, name, err := s.fs.registerBuffer(b)
+	if err != nil {
+		b.forget()
+		return
+	}
+
 	fd, err = syscall.Open(path.Join(m.Mountpoint, name), mode, 0)
-	m.fs.forgetBufferName(name)
+	s.fs.forgetBufferName(name)
 	if err != nil {
-		m.fs.forgetBufferNode(id)
+		s.fs.forgetBufferNode(id)
+		return
+	}
+
+	// Promotion calls buffer methods, so it may start only after creation
+	// can no longer fail.
+	if b.promo != nil {
+		b.promo.start(b, m.ErrorLog)
 	}
 	return
 }
+
+// forget a buffer.  It's the last thing done with a buffer, whether it was
+// registered or not.
+func (b *buffer) forget() {
+	if b.promo != nil {
+		b.promo.forget()
+	}
+	if b.hooks != nil {
+		b.hooks.BufferForgotten()
+	}
+}
+
+// Reopen a file descriptor returned by Create or CreateCloned.  The new file
+// descriptor refers to the same buffer, or to a sealed memory file with the
+// same content if the buffer has been promoted.  Existing file descriptors
+// and mappings are not affected by promotion.
+func (m *Manager) Reopen(fd, mode int) (newFd int, err error) {
+	s, id, b, err := m.lookupFd(fd)
+	if err != nil {
+		return
+	}
+
+	if b.kind == kindTemporal {
+		err = syscall.EINVAL
+		return
+	}
+
+	if b.promo != nil {
+		var ok bool
+
+		newFd, ok, err = b.promo.open(mode)
+		if ok {
+			return
+		}
+	}
+
+	newFd, err = m.openNode(s, id, mode)
+	return
+}
+
+// lookupFd finds the buffer of a file descriptor returned by a Create method.
+func (m *Manager) lookupFd(fd int) (s *session, id fuseops.InodeID, b buffer, err error) {
+	var st syscall.Stat_t
+
+	err = syscall.Fstat(fd, &st)
+	if err != nil {
+		return
+	}
+
+	s = m.current()
+
+	if uint64(st.Dev) != s.dev {
+		err = syscall.EINVAL
+		return
+	}
+
+	id = fuseops.InodeID(st.Ino)
+
+	b, found := s.fs.lookupBuffer(id)
+	if !found {
+		err = syscall.EBADF
+	}
+	return
+}
+
+// openNode opens an existing buffer via a new name.
+func (m *Manager) openNode(s *session, id fuseops.InodeID, mode int) (fd int, err error) {
+	name, found := s.fs.registerBufferName(id)
+	if !found {
+		err = syscall.EBADF
+		return
+	}
+
+	fd, err = syscall.Open(path.Join(m.Mountpoint, name), mode, 0)
+	s.fs.forgetBufferName(name)
+	return
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package chaos wraps buffers to simulate slow and failing sources, for
+// testing how consumers cope with them.  Faults are injected into reads;
+// writes, closing and the optional lazymem buffer interfaces are passed
+// through.
+package chaos
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/internal/wrap"
+)
+
+// Config of injected faults.  The zero value injects nothing.
+type Config struct {
+	// Seed makes the random decisions reproducible.
+	Seed int64
+
+	// Latency added to each read.  Nil means none.
+	Latency Distribution
+
+	// Bandwidth limit in bytes per second, shared by all reads of the
+	// buffer.  Zero means unlimited.
+	Bandwidth int64
+
+	// ErrorOffsets fail the reads which cover any of them.  The data before
+	// the offset is returned.
+	ErrorOffsets []int64
+
+	// ErrorRate is the probability of a read failing without returning any
+	// data.
+	ErrorRate float64
+
+	// Err is the injected error.  Defaults to syscall.EIO.
+	Err error
+
+	// ShortReadRate is the probability of a read returning only part of the
+	// requested data without an error, violating the io.ReaderAt contract.
+	ShortReadRate float64
+}
+
+// Distribution of durations.
+type Distribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// Constant duration.
+type Constant time.Duration
+
+func (d Constant) Sample(*rand.Rand) time.Duration { return time.Duration(d) }
+
+// Uniform distribution between Min and Max.
+type Uniform struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (d Uniform) Sample(r *rand.Rand) time.Duration {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + time.Duration(r.Int63n(int64(d.Max-d.Min)))
+}
+
+// Exponential distribution with a mean.  Most samples are short, with a
+// long tail.
+type Exponential struct {
+	Mean time.Duration
+}
+
+func (d Exponential) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(d.Mean))
+}
+
+// Normal distribution, truncated at zero.
+type Normal struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (d Normal) Sample(r *rand.Rand) time.Duration {
+	x := time.Duration(r.NormFloat64()*float64(d.StdDev)) + d.Mean
+	if x < 0 {
+		x = 0
+	}
+	return x
+}
+
+type reader struct {
+	r   io.ReaderAt
+	c   Config
+	err error
+
+	lock sync.Mutex
+	rand *rand.Rand
+	next time.Time // bandwidth limiter
+}
+
+func newReader(r io.ReaderAt, c *Config) *reader {
+	x := &reader{r: r, err: syscall.EIO}
+	if c != nil {
+		x.c = *c
+	}
+	if x.c.Err != nil {
+		x.err = x.c.Err
+	}
+	x.rand = rand.New(rand.NewSource(x.c.Seed))
+	return x
+}
+
+type decision struct {
+	delay time.Duration
+	fail  bool
+	short int
+}
+
+func (x *reader) decide(length int) (d decision) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if x.c.Latency != nil {
+		d.delay = x.c.Latency.Sample(x.rand)
+	}
+
+	d.fail = x.c.ErrorRate > 0 && x.rand.Float64() < x.c.ErrorRate
+
+	if x.c.ShortReadRate > 0 && x.rand.Float64() < x.c.ShortReadRate && length > 1 {
+		d.short = 1 + x.rand.Intn(length-1)
+	}
+
+	if x.c.Bandwidth > 0 {
+		now := time.Now()
+		if x.next.Before(now) {
+			x.next = now
+		}
+		x.next = x.next.Add(time.Duration(int64(length) * int64(time.Second) / x.c.Bandwidth))
+		if wait := x.next.Sub(now); wait > d.delay {
+			d.delay = wait
+		}
+	}
+	return
+}
+
+// failAt returns the position of the first error offset within a range, or
+// -1.
+func (x *reader) failAt(offset int64, length int) (n int) {
+	n = -1
+	for _, o := range x.c.ErrorOffsets {
+		if o >= offset && o < offset+int64(length) && (n < 0 || int(o-offset) < n) {
+			n = int(o - offset)
+		}
+	}
+	return
+}
+
+func (x *reader) ReadAt(b []byte, offset int64) (int, error) {
+	return x.ReadAtContext(context.Background(), b, offset)
+}
+
+// ReadAtContext is like ReadAt.  The injected delay and the wrapped buffer's
+// ReadAtContext are interrupted when the context is done.
+func (x *reader) ReadAtContext(ctx context.Context, b []byte, offset int64) (n int, err error) {
+	d := x.decide(len(b))
+
+	if d.delay > 0 {
+		timer := time.NewTimer(d.delay)
+		select {
+		case <-timer.C:
+
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			return
+		}
+	}
+
+	if d.fail {
+		err = x.err
+		return
+	}
+
+	failAt := x.failAt(offset, len(b))
+
+	if failAt >= 0 {
+		b = b[:failAt]
+	} else if d.short > 0 {
+		b = b[:d.short]
+	}
+
+	if len(b) > 0 {
+		n, err = wrap.ReadAtContext(ctx, x.r, b, offset)
+	}
+	if err == nil && failAt >= 0 {
+		err = x.err
+	}
+	return
+}
+
+// Temporal wraps a TemporalBuffer.
+func Temporal(b lazymem.TemporalBuffer, c *Config) lazymem.TemporalBuffer {
+	return wrap.Buffer(b, newReader(b, c), nil, nil).(lazymem.TemporalBuffer)
+}
+
+// Cloned wraps a ClonedBuffer.
+func Cloned(b lazymem.ClonedBuffer, c *Config) lazymem.ClonedBuffer {
+	return wrap.Buffer(b, newReader(b, c), nil, b).(lazymem.ClonedBuffer)
+}
+
+// Shared wraps a SharedBuffer.
+func Shared(b lazymem.SharedBuffer, c *Config) lazymem.SharedBuffer {
+	return wrap.Buffer(b, newReader(b, c), b, b).(lazymem.SharedBuffer)
+}
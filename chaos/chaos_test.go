@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chaos_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/chaos"
+	"github.com/tsavola/lazymem/linear"
+)
+
+type source []byte
+
+func (s source) ReadAt(b []byte, offset int64) (int, error) { return copy(b, s[offset:]), nil }
+func (s source) Close() error                               { return nil }
+
+func TestErrorOffsets(t *testing.T) {
+	b := chaos.Cloned(source(make([]byte, 1000)), &chaos.Config{
+		ErrorOffsets: []int64{500, 300},
+	})
+
+	n, err := b.ReadAt(make([]byte, 400), 200)
+	if n != 100 || err != syscall.EIO {
+		t.Error(n, err)
+	}
+
+	n, err = b.ReadAt(make([]byte, 100), 600)
+	if n != 100 || err != nil {
+		t.Error(n, err)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	config := &chaos.Config{
+		Seed:          12345,
+		Latency:       chaos.Uniform{Max: time.Millisecond},
+		ErrorRate:     0.2,
+		ShortReadRate: 0.3,
+		Err:           io.ErrUnexpectedEOF,
+	}
+
+	var results [2][]byte
+
+	for i := range results {
+		b := chaos.Temporal(source(make([]byte, 4096)), config)
+
+		var log bytes.Buffer
+		for j := 0; j < 100; j++ {
+			n, err := b.ReadAt(make([]byte, 4096), 0)
+			log.WriteByte(byte(n))
+			log.WriteByte(byte(n >> 8))
+			if err != nil {
+				log.WriteString(err.Error())
+			}
+		}
+		results[i] = log.Bytes()
+	}
+
+	if !bytes.Equal(results[0], results[1]) {
+		t.Error("results differ")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	b := chaos.Cloned(source(make([]byte, 100000)), &chaos.Config{
+		Bandwidth: 1000000,
+	})
+
+	t0 := time.Now()
+	for i := 0; i < 10; i++ {
+		b.ReadAt(make([]byte, 10000), int64(i)*10000)
+	}
+
+	if d := time.Since(t0); d < 90*time.Millisecond {
+		t.Error(d)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	if _, ok := chaos.Cloned(source(make([]byte, 1000)), nil).(lazymem.PopulatedBuffer); ok {
+		t.Error("PopulatedBuffer implemented without source support")
+	}
+
+	buf := linear.NewBuffer(make([]byte, 1000))
+	buf.BlocksPopulated(0, 1)
+
+	b := chaos.Cloned(struct {
+		*linear.Buffer
+		*lazymem.Lifecycle
+	}{buf, lazymem.NewLifecycle(context.Background())}, &chaos.Config{
+		ErrorOffsets: []int64{500},
+	})
+
+	if _, ok := b.(lazymem.PopulatedBuffer); !ok {
+		t.Error("PopulatedBuffer not forwarded")
+	}
+	if _, ok := b.(lazymem.LifecycleBuffer); !ok {
+		t.Error("LifecycleBuffer not forwarded")
+	}
+
+	n, err := b.ReadAt(make([]byte, 400), 200)
+	if n != 300 || err != syscall.EIO {
+		t.Error(n, err)
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Program lazymem serves a file, standard input or an HTTP(S) resource as a
+// lazily populated memory buffer to a child process.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/daemon"
+	"github.com/tsavola/lazymem/linear"
+	"github.com/tsavola/lazymem/sparse"
+)
+
+const frameSize = linear.BlockSize
+
+var (
+	kind       = "temporal"
+	fdNum      = 3
+	sizeEnv    = "LAZYMEM_SIZE"
+	size       int64
+	mountpoint string
+	debug      bool
+	daemonMode bool
+	socketPath = daemon.DefaultSocket()
+	drainTime  = 5 * time.Second
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] source command [arg...]\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "       %s -daemon [options]\n\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "Source may be a filename, - for stdin, or an http:// or https:// URL.\n\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("lazymem: ")
+
+	flag.Usage = usage
+	flag.StringVar(&kind, "kind", kind, "buffer kind: temporal, cloned or shared")
+	flag.IntVar(&fdNum, "fd", fdNum, "file descriptor number in child process")
+	flag.StringVar(&sizeEnv, "env", sizeEnv, "environment variable for buffer size")
+	flag.Int64Var(&size, "size", size, "buffer size (required if source size is unknown)")
+	flag.StringVar(&mountpoint, "mountpoint", mountpoint, "filesystem location (default: $XDG_RUNTIME_DIR/lazymem/PID)")
+	flag.BoolVar(&debug, "debug", debug, "log filesystem operations")
+	flag.BoolVar(&daemonMode, "daemon", daemonMode, "serve buffers to clients via a Unix socket")
+	flag.StringVar(&socketPath, "socket", socketPath, "Unix socket path in daemon mode")
+	flag.DurationVar(&drainTime, "drain", drainTime, "how long to wait for buffers to be released before detaching")
+	flag.Parse()
+
+	var (
+		exitCode int
+		err      error
+	)
+
+	if daemonMode {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		err = runDaemon()
+	} else {
+		if flag.NArg() < 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		exitCode, err = run(flag.Arg(0), flag.Args()[1:])
+	}
+
+	if err != nil {
+		log.Print(err)
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+
+	os.Exit(exitCode)
+}
+
+// run a command with a buffer.  The exit code is the command's.
+func run(source string, command []string) (exitCode int, err error) {
+	switch kind {
+	case "temporal", "cloned", "shared":
+	default:
+		err = fmt.Errorf("invalid buffer kind: %s", kind)
+		return
+	}
+
+	if fdNum < 0 {
+		err = fmt.Errorf("invalid file descriptor number: %d", fdNum)
+		return
+	}
+
+	ctx := context.Background()
+
+	r, sourceSize, err := openSource(source)
+	if err != nil {
+		return
+	}
+
+	// The producer is stopped by closing the source, so that it doesn't
+	// outlive the command.
+	var (
+		stop     = make(chan struct{})
+		producer sync.WaitGroup
+	)
+	defer func() {
+		close(stop)
+		r.Close()
+		producer.Wait()
+	}()
+
+	bufSize := size
+	if bufSize == 0 {
+		bufSize = sourceSize
+	}
+	if bufSize <= 0 {
+		err = fmt.Errorf("size of %s is unknown; specify -size", source)
+		return
+	}
+
+	m, err := lazymem.New(ctx, newConfig())
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := shutdown(m); err == nil {
+			err = e
+		}
+	}()
+
+	fd, err := serve(m, r, kind, bufSize, stop, &producer)
+	if err != nil {
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "lazymem")
+	defer f.Close()
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), sizeEnv+"="+strconv.FormatInt(bufSize, 10))
+
+	switch fdNum {
+	case 0:
+		cmd.Stdin = f
+	case 1:
+		cmd.Stdout = f
+	case 2:
+		cmd.Stderr = f
+	default:
+		cmd.ExtraFiles = make([]*os.File, fdNum-2)
+		cmd.ExtraFiles[fdNum-3] = f
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			err = nil
+			if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				exitCode = 128 + int(status.Signal())
+			} else {
+				exitCode = exit.ExitCode()
+			}
+		}
+	}
+	return
+}
+
+func newConfig() *lazymem.Config {
+	config := &lazymem.Config{
+		Mountpoint:       mountpoint,
+		ErrorLog:         log.New(os.Stderr, "lazymem: ", 0),
+		DetachOnShutdown: true,
+	}
+	if debug {
+		config.DebugLog = log.New(os.Stderr, "lazymem: ", 0)
+	}
+	return config
+}
+
+func runDaemon() (err error) {
+	ctx := context.Background()
+
+	m, err := lazymem.New(ctx, newConfig())
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := shutdown(m); err == nil {
+			err = e
+		}
+	}()
+
+	err = os.MkdirAll(path.Dir(socketPath), 0700)
+	if err != nil {
+		return
+	}
+
+	l, err := daemon.Listen(socketPath)
+	if err != nil {
+		return
+	}
+	defer l.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		<-signals
+		l.Close()
+	}()
+
+	s := &daemon.Server{
+		Manager:  m,
+		ErrorLog: log.New(os.Stderr, "", 0),
+	}
+
+	err = s.Serve(l)
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return
+}
+
+func openSource(source string) (r io.ReadCloser, size int64, err error) {
+	switch {
+	case source == "-":
+		r = os.Stdin
+		size = regularFileSize(os.Stdin)
+
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		var resp *http.Response
+
+		resp, err = http.Get(source)
+		if err != nil {
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("%s: %s", source, resp.Status)
+			return
+		}
+
+		r = resp.Body
+		size = resp.ContentLength
+
+	default:
+		var f *os.File
+
+		f, err = os.Open(source)
+		if err != nil {
+			return
+		}
+
+		r = f
+		size = regularFileSize(f)
+	}
+	return
+}
+
+func regularFileSize(f *os.File) int64 {
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		return info.Size()
+	}
+	return -1
+}
+
+// serve creates the buffer and starts populating it in the background.  The
+// producer is added to the wait group.  It stops quietly if the source fails
+// after the stop channel has been closed.
+func serve(m *lazymem.Manager, r io.Reader, kind string, size int64, stop <-chan struct{}, producer *sync.WaitGroup) (fd int, err error) {
+	if kind == "temporal" {
+		buf := sparse.NewBuffer()
+
+		fd, err = m.CreateTemporal(size, syscall.O_RDONLY|syscall.O_CLOEXEC, buf)
+		if err != nil {
+			return
+		}
+
+		producer.Add(1)
+		go func() {
+			defer producer.Done()
+			produceFrames(buf, r, size, stop)
+		}()
+		return
+	}
+
+	buf, err := linear.NewMappedBuffer(int(size))
+	if err != nil {
+		return
+	}
+
+	if kind == "shared" {
+		fd, err = m.Create(size, syscall.O_RDWR|syscall.O_CLOEXEC, buf)
+	} else {
+		fd, err = m.CreateCloned(size, syscall.O_RDONLY|syscall.O_CLOEXEC, buf)
+	}
+	if err != nil {
+		buf.Free()
+		return
+	}
+
+	producer.Add(1)
+	go func() {
+		defer producer.Done()
+		populateBlocks(buf, r, stop)
+	}()
+	return
+}
+
+func produceFrames(buf *sparse.Buffer, r io.Reader, size int64, stop <-chan struct{}) {
+	defer buf.ProductionFinished()
+
+	for offset := int64(0); offset < size; {
+		n := int64(frameSize)
+		if remain := size - offset; remain < n {
+			n = remain
+		}
+
+		data := make([]byte, n)
+
+		if _, err := io.ReadFull(r, data); err != nil {
+			logSourceError(err, stop)
+			return
+		}
+
+		buf.ProduceFrame(data, offset)
+		offset += n
+	}
+}
+
+func populateBlocks(buf *linear.Buffer, r io.Reader, stop <-chan struct{}) {
+	defer buf.PopulationFinished()
+
+	mem := buf.Bytes()
+
+	for i := 0; len(mem) > 0; i++ {
+		n := linear.BlockSize
+		if n > len(mem) {
+			n = len(mem)
+		}
+
+		if _, err := io.ReadFull(r, mem[:n]); err != nil {
+			logSourceError(err, stop)
+			return
+		}
+
+		buf.BlockPopulated(i)
+		mem = mem[n:]
+	}
+}
+
+func logSourceError(err error, stop <-chan struct{}) {
+	select {
+	case <-stop:
+	default:
+		log.Printf("reading source: %v", err)
+	}
+}
+
+func shutdown(m *lazymem.Manager) error {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTime)
+	defer cancel()
+
+	outcome, err := m.Drain(ctx)
+	switch outcome {
+	case lazymem.ShutdownDetached:
+		log.Print("buffers were still in use; filesystem detached")
+
+	case lazymem.ShutdownUnmounted:
+		log.Printf("filesystem had been unmounted: %v", m.Err())
+	}
+	return err
+}
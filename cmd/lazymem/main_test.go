@@ -0,0 +1,129 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testData() []byte {
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// runCat runs a shell which copies the buffer to a file, and lists the
+// shell's file descriptors which refer to the buffer.
+func runCat(t *testing.T, source string) (output []byte, fds string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	out := path.Join(dir, "out")
+	list := path.Join(dir, "fds")
+
+	mountpoint = path.Join(dir, "mnt")
+	size = 0
+
+	script := `test "$LAZYMEM_SIZE" -gt 0 && cat <&3 >` + out + ` && for fd in /proc/$$/fd/*; do readlink $fd; done | grep ` + mountpoint + ` >` + list
+
+	exitCode, err := run(source, []string{"sh", "-c", script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode != 0 {
+		t.Fatalf("exit code: %d", exitCode)
+	}
+
+	output, err = ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds = string(b)
+	return
+}
+
+func TestRun(t *testing.T) {
+	data := testData()
+
+	filename := path.Join(t.TempDir(), "source")
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"temporal", "cloned", "shared"} {
+		t.Run(k, func(t *testing.T) {
+			kind = k
+
+			output, fds := runCat(t, filename)
+			if !bytes.Equal(output, data) {
+				t.Error("content mismatch")
+			}
+			if n := strings.Count(fds, "\n"); n != 1 {
+				t.Errorf("child has %d buffer file descriptors:\n%s", n, fds)
+			}
+		})
+	}
+}
+
+func TestRunHTTP(t *testing.T) {
+	data := testData()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	kind = "temporal"
+
+	if output, _ := runCat(t, server.URL); !bytes.Equal(output, data) {
+		t.Error("content mismatch")
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	kind = "temporal"
+	mountpoint = path.Join(t.TempDir(), "mnt")
+	size = 4096
+
+	exitCode, err := run("/dev/zero", []string{"sh", "-c", "exit 42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCode != 42 {
+		t.Errorf("exit code: %d", exitCode)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	kind = "invalid"
+	if _, err := run("/dev/zero", []string{"true"}); err == nil {
+		t.Error("invalid kind accepted")
+	}
+
+	kind = "temporal"
+	size = 0
+	if _, err := run("/dev/zero", []string{"true"}); err == nil {
+		t.Error("unknown size accepted")
+	}
+
+	if _, err := run(path.Join(t.TempDir(), "nonexistent"), []string{"true"}); err == nil {
+		t.Error("nonexistent source accepted")
+	}
+}
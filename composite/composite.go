@@ -0,0 +1,235 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package composite implements buffers which lay out other buffers within
+// one file.  A composite buffer can be passed to any Manager.Create method
+// which suits all of its parts; e.g. parts which are sparse buffers make it
+// a TemporalBuffer.
+package composite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/tsavola/lazymem/internal/wrap"
+)
+
+// ErrNotWritable is returned by WriteAt for ranges without a writable part.
+var ErrNotWritable = errors.New("composite: range is not writable")
+
+var zeros [65536]byte
+
+// Part of a composite buffer.  Source is read from its offset zero.  Nil
+// Source reads as zeros, like the gaps between parts.
+type Part struct {
+	Offset int64
+	Length int64
+	Source io.ReaderAt
+}
+
+func (p *Part) end() int64 { return p.Offset + p.Length }
+
+// Buffer implements io.ReaderAt, io.WriterAt, io.Closer and ReadAtContext.
+type Buffer struct {
+	size  int64
+	parts []Part
+}
+
+// New buffer of a given size.  The parts must not overlap.
+func New(size int64, parts ...Part) (b *Buffer, err error) {
+	b = &Buffer{
+		size:  size,
+		parts: append([]Part(nil), parts...),
+	}
+
+	sort.Slice(b.parts, func(i, j int) bool {
+		return b.parts[i].Offset < b.parts[j].Offset
+	})
+
+	var prevEnd int64
+
+	for _, p := range b.parts {
+		if p.Offset < 0 || p.Length < 0 || p.end() > size {
+			err = fmt.Errorf("composite: part out of bounds: offset %d, length %d", p.Offset, p.Length)
+			return
+		}
+		if p.Offset < prevEnd {
+			err = fmt.Errorf("composite: parts overlap at offset %d", p.Offset)
+			return
+		}
+		prevEnd = p.end()
+	}
+	return
+}
+
+func (b *Buffer) Len() int64 { return b.size }
+
+// find the part containing the offset, or the next part.  Returns nil if
+// there are no parts at or after the offset.
+func (b *Buffer) find(offset int64) *Part {
+	i := sort.Search(len(b.parts), func(i int) bool {
+		return b.parts[i].end() > offset
+	})
+	if i < len(b.parts) {
+		return &b.parts[i]
+	}
+	return nil
+}
+
+// span returns the part which contains the offset (nil for zeros) and the
+// number of bytes available from it, limited by the length.
+func (b *Buffer) span(offset int64, length int) (part *Part, n int) {
+	end := offset + int64(length)
+
+	part = b.find(offset)
+	switch {
+	case part == nil:
+		// trailing zeros
+
+	case part.Offset > offset:
+		// zeros before part
+		if part.Offset < end {
+			end = part.Offset
+		}
+		part = nil
+
+	default:
+		if part.end() < end {
+			end = part.end()
+		}
+		if part.Source == nil {
+			part = nil
+		}
+	}
+
+	n = int(end - offset)
+	return
+}
+
+// clamp length to the buffer size.
+func (b *Buffer) clamp(offset int64, length int) (int, error) {
+	if offset >= b.size {
+		return 0, io.EOF
+	}
+	if int64(length) > b.size-offset {
+		return int(b.size - offset), io.EOF
+	}
+	return length, nil
+}
+
+func (b *Buffer) ReadAt(dest []byte, offset int64) (int, error) {
+	return b.ReadAtContext(context.Background(), dest, offset)
+}
+
+// ReadAtContext is like ReadAt.  The context is passed to the parts which
+// implement ReadAtContext.
+func (b *Buffer) ReadAtContext(ctx context.Context, dest []byte, offset int64) (n int, err error) {
+	length, eof := b.clamp(offset, len(dest))
+	dest = dest[:length]
+
+	for len(dest) > 0 {
+		part, spanLen := b.span(offset, len(dest))
+
+		var m int
+
+		if part == nil {
+			m = copyZeros(dest[:spanLen])
+		} else {
+			m, err = wrap.ReadAtContext(ctx, part.Source, dest[:spanLen], offset-part.Offset)
+			if m == spanLen && err == io.EOF {
+				err = nil
+			}
+			if m == 0 && err == nil {
+				err = io.ErrNoProgress
+			}
+		}
+
+		n += m
+		if err != nil {
+			return
+		}
+
+		dest = dest[m:]
+		offset += int64(m)
+	}
+
+	err = eof
+	return
+}
+
+func sourceOf(p *Part) io.ReaderAt {
+	if p == nil {
+		return nil
+	}
+	return p.Source
+}
+
+// WriteAt writes to parts which implement io.WriterAt.
+func (b *Buffer) WriteAt(source []byte, offset int64) (n int, err error) {
+	length, eof := b.clamp(offset, len(source))
+	source = source[:length]
+
+	for len(source) > 0 {
+		part, spanLen := b.span(offset, len(source))
+
+		w, ok := sourceOf(part).(io.WriterAt)
+		if !ok {
+			err = ErrNotWritable
+			return
+		}
+
+		var m int
+
+		m, err = w.WriteAt(source[:spanLen], offset-part.Offset)
+		n += m
+		if m == 0 && err == nil {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return
+		}
+
+		source = source[m:]
+		offset += int64(m)
+	}
+
+	err = eof
+	return
+}
+
+// Close the parts which implement io.Closer.  A source which appears in
+// multiple parts is closed once, unless its type is not comparable.
+func (b *Buffer) Close() (err error) {
+	closed := make(map[io.Closer]bool)
+
+	for _, p := range b.parts {
+		c, ok := p.Source.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		if reflect.TypeOf(c).Comparable() {
+			if closed[c] {
+				continue
+			}
+			closed[c] = true
+		}
+
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func copyZeros(dest []byte) (n int) {
+	for n < len(dest) {
+		n += copy(dest[n:], zeros[:])
+	}
+	return
+}
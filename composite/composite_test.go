@@ -0,0 +1,148 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package composite_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/tsavola/lazymem/composite"
+	"github.com/tsavola/lazymem/linear"
+	"github.com/tsavola/lazymem/sparse"
+)
+
+func pattern(n, seed int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*seed + 1)
+	}
+	return b
+}
+
+func TestLayout(t *testing.T) {
+	const size = 40000
+
+	header := pattern(100, 3)
+	segment := pattern(5000, 5)
+	tail := pattern(3000, 7)
+
+	headerBuf := linear.NewBuffer(append([]byte(nil), header...))
+	headerBuf.BlocksPopulated(0, 1)
+
+	segmentBuf := sparse.NewBuffer()
+	segmentBuf.ProduceFrame(append([]byte(nil), segment[2000:]...), 2000)
+	segmentBuf.ProduceFrame(append([]byte(nil), segment[:2000]...), 0)
+
+	b, err := composite.New(size,
+		composite.Part{Offset: 30000, Length: int64(len(tail)), Source: bytes.NewReader(tail)},
+		composite.Part{Offset: 0, Length: int64(len(header)), Source: headerBuf},
+		composite.Part{Offset: 4096, Length: int64(len(segment)), Source: segmentBuf},
+		composite.Part{Offset: 20000, Length: 1000}, // explicit zeros
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := make([]byte, size)
+	copy(expect, header)
+	copy(expect[4096:], segment)
+	copy(expect[30000:], tail)
+
+	// The sparse part can be read only once, so read everything in
+	// irregular chunks which cross part boundaries.
+	result := make([]byte, size)
+	for offset := 0; offset < size; {
+		n := 3333
+		if n > size-offset {
+			n = size - offset
+		}
+
+		m, err := b.ReadAt(result[offset:offset+n], int64(offset))
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		if m != n {
+			t.Fatalf("offset %d: short read", offset)
+		}
+		offset += n
+	}
+
+	if !bytes.Equal(result, expect) {
+		t.Error("content mismatch")
+	}
+
+	n, err := b.ReadAt(make([]byte, 100), size-50)
+	if n != 50 || err != io.EOF {
+		t.Errorf("read past end: %d, %v", n, err)
+	}
+
+	if _, err := b.WriteAt([]byte{1}, 10); err != nil {
+		t.Errorf("write to linear part: %v", err)
+	}
+	if _, err := b.WriteAt([]byte{1, 2}, 99); err != composite.ErrNotWritable {
+		t.Errorf("write to gap: %v", err)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	_, err := composite.New(100,
+		composite.Part{Offset: 0, Length: 60},
+		composite.Part{Offset: 50, Length: 10},
+	)
+	if err == nil {
+		t.Error("overlap accepted")
+	}
+
+	_, err = composite.New(100, composite.Part{Offset: 90, Length: 20})
+	if err == nil {
+		t.Error("out of bounds part accepted")
+	}
+}
+
+type countingCloser struct {
+	io.ReaderAt
+	closed int
+}
+
+func (c *countingCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	c := &countingCloser{ReaderAt: bytes.NewReader(make([]byte, 10))}
+
+	b, err := composite.New(100,
+		composite.Part{Offset: 0, Length: 10, Source: c},
+		composite.Part{Offset: 50, Length: 10, Source: c},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.closed != 1 {
+		t.Errorf("closed %d times", c.closed)
+	}
+}
+
+type stuckReader struct{}
+
+func (stuckReader) ReadAt([]byte, int64) (int, error) { return 0, nil }
+
+func TestNoProgress(t *testing.T) {
+	b, err := composite.New(100, composite.Part{Offset: 10, Length: 10, Source: stuckReader{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := b.ReadAt(make([]byte, 100), 0)
+	if n != 10 || err != io.ErrNoProgress {
+		t.Errorf("read: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+
+	"github.com/jacobsa/fuse"
+)
+
+const (
+	maxMaxRead      = 131072  // FUSE binding's reply buffer size
+	maxMaxReadahead = 1048576 // FUSE binding's init response
+)
+
+// Mount options which are set by Manager or the mount helper.
+var reservedMountOptions = []string{
+	"fd",
+	"fsname",
+	"group_id",
+	"max_read",
+	"ro",
+	"rootmode",
+	"rw",
+	"subtype",
+	"user_id",
+}
+
+func (c *Config) validate() error {
+	if err := validateSize("MaxRead", c.MaxRead, maxMaxRead); err != nil {
+		return err
+	}
+
+	if err := validateSize("MaxReadahead", c.MaxReadahead, maxMaxReadahead); err != nil {
+		return err
+	}
+
+	for _, key := range reservedMountOptions {
+		if _, found := c.MountOptions[key]; found {
+			return fmt.Errorf("lazymem: mount option %q must not be set via MountOptions", key)
+		}
+	}
+
+	return nil
+}
+
+func validateSize(name string, value, max int) error {
+	if value < 0 || value > max || value%pagesize != 0 {
+		return fmt.Errorf("lazymem: %s must be a multiple of %d between 0 and %d: %d", name, pagesize, max, value)
+	}
+	return nil
+}
+
+func (c *Config) mountConfig(ctx context.Context) *fuse.MountConfig {
+	fsName := c.FSName
+	if fsName == "" {
+		fsName = "lazymem"
+	}
+
+	options := make(map[string]string)
+	for key, value := range c.MountOptions {
+		options[key] = value
+	}
+	if c.MaxRead > 0 {
+		options["max_read"] = strconv.Itoa(c.MaxRead)
+	}
+
+	errorLogger := adaptLogger(c.ErrorLog)
+	if errorLogger == nil && c.LogHandler != nil {
+		errorLogger = slog.NewLogLogger(c.LogHandler, slog.LevelError)
+	}
+
+	// There is no async read option: the binding doesn't negotiate
+	// FUSE_ASYNC_READ with the kernel.
+	return &fuse.MountConfig{
+		OpContext:   ctx,
+		FSName:      fsName,
+		Subtype:     "lazymem",
+		ReadOnly:    c.ReadOnly,
+		ErrorLogger: errorLogger,
+		DebugLogger: adaptLogger(c.DebugLog),
+
+		DisableWritebackCaching: c.DisableWritebackCaching,
+		Options:                 options,
+	}
+}
+
+// setReadahead of the mounted filesystem's backing device info.
+func setReadahead(dev uint64, size int) error {
+	major := (dev >> 8) & 0xfff
+	minor := (dev & 0xff) | ((dev >> 12) & 0xfff00)
+
+	filename := fmt.Sprintf("/sys/class/bdi/%d:%d/read_ahead_kb", major, minor)
+	return ioutil.WriteFile(filename, []byte(strconv.Itoa(size/1024)), 0)
+}
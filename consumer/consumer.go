@@ -0,0 +1,147 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package consumer maps lazymem file descriptors received from a producer.
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/tsavola/lazymem/handoff"
+)
+
+var pagesize = syscall.Getpagesize()
+
+// ErrUnmapped is returned when a Mapping is used after Unmap.
+var ErrUnmapped = errors.New("consumer: memory has been unmapped")
+
+// Mapping of a lazymem buffer.
+type Mapping struct {
+	Header handoff.Header
+
+	lock sync.Mutex
+	mem  []byte
+}
+
+// Map a file descriptor described by a header.  flags must include either
+// syscall.MAP_SHARED or MAP_PRIVATE, and it must be allowed by the header.
+// The mapping length is the size specified in the header.  The file
+// descriptor may be closed after mapping.
+func Map(fd int, h handoff.Header, prot, flags int) (m *Mapping, err error) {
+	err = h.Validate()
+	if err != nil {
+		return
+	}
+
+	switch share := flags & (syscall.MAP_SHARED | syscall.MAP_PRIVATE); share {
+	case syscall.MAP_SHARED, syscall.MAP_PRIVATE:
+		if share&h.Flags == 0 {
+			err = fmt.Errorf("consumer: %v buffer cannot be mapped with flags 0x%x", h.Kind, flags)
+			return
+		}
+
+	default:
+		err = errors.New("consumer: either MAP_SHARED or MAP_PRIVATE must be specified")
+		return
+	}
+
+	var st syscall.Stat_t
+
+	err = syscall.Fstat(fd, &st)
+	if err != nil {
+		return
+	}
+
+	if st.Size != h.Size {
+		err = fmt.Errorf("consumer: file size %d differs from header size %d", st.Size, h.Size)
+		return
+	}
+
+	mem, err := syscall.Mmap(fd, 0, int(h.Size), prot, flags)
+	if err != nil {
+		return
+	}
+
+	m = &Mapping{
+		Header: h,
+		mem:    mem,
+	}
+	return
+}
+
+// Bytes of the mapped memory, or nil after Unmap.  Slices must not be
+// accessed after Unmap.
+func (m *Mapping) Bytes() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.mem
+}
+
+// Len of the mapping.
+func (m *Mapping) Len() int {
+	return int(m.Header.Size)
+}
+
+// Prefetch hints that a range will be accessed soon.
+func (m *Mapping) Prefetch(offset, length int64) error {
+	return m.advise(offset, length, syscall.MADV_WILLNEED)
+}
+
+// Sequential hints that the memory will be accessed in order.
+func (m *Mapping) Sequential() error {
+	return m.advise(0, m.Header.Size, syscall.MADV_SEQUENTIAL)
+}
+
+// Random hints that the memory will be accessed randomly, so reading ahead
+// is not useful.
+func (m *Mapping) Random() error {
+	return m.advise(0, m.Header.Size, syscall.MADV_RANDOM)
+}
+
+// Discard a range of pages; they will be read again from the buffer when
+// accessed.  Private modifications are lost.  Temporal buffers don't support
+// rereading, so an error is returned for them.
+func (m *Mapping) Discard(offset, length int64) error {
+	if m.Header.Kind == handoff.Temporal {
+		return errors.New("consumer: temporal buffer cannot be reread")
+	}
+
+	return m.advise(offset, length, syscall.MADV_DONTNEED)
+}
+
+func (m *Mapping) advise(offset, length int64, advice int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.mem == nil {
+		return ErrUnmapped
+	}
+
+	if offset < 0 || length < 0 || offset+length > int64(len(m.mem)) {
+		return fmt.Errorf("consumer: range [%d, %d) is out of bounds", offset, offset+length)
+	}
+
+	// madvise requires page alignment
+	mask := int64(pagesize - 1)
+	begin := offset &^ mask
+	end := offset + length
+
+	return syscall.Madvise(m.mem[begin:end], advice)
+}
+
+// Unmap the memory.  It can be called multiple times.
+func (m *Mapping) Unmap() (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.mem != nil {
+		err = syscall.Munmap(m.mem)
+		m.mem = nil
+	}
+	return
+}
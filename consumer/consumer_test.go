@@ -0,0 +1,139 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package consumer_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/tsavola/lazymem/consumer"
+	"github.com/tsavola/lazymem/handoff"
+	"github.com/tsavola/lazymem/internal/memfd"
+)
+
+const testSize = 65536
+
+func newFile(t *testing.T) int {
+	t.Helper()
+
+	fd, err := memfd.Create("consumer-test", memfd.CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Ftruncate(fd, testSize); err != nil {
+		t.Fatal(err)
+	}
+
+	return fd
+}
+
+func TestMap(t *testing.T) {
+	fd := newFile(t)
+	defer syscall.Close(fd)
+
+	h := handoff.Header{
+		Size:  testSize,
+		Kind:  handoff.Temporal,
+		Flags: syscall.MAP_PRIVATE,
+	}
+
+	m, err := consumer.Map(fd, h, syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Prefetch(100, 10000); err != nil {
+		t.Error(err)
+	}
+
+	if err := m.Discard(0, testSize); err == nil {
+		t.Error("temporal buffer discarded")
+	}
+
+	if len(m.Bytes()) != testSize {
+		t.Error(len(m.Bytes()))
+	}
+
+	if err := m.Unmap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Unmap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Prefetch(0, 1); err != consumer.ErrUnmapped {
+		t.Error(err)
+	}
+}
+
+func TestMapRejected(t *testing.T) {
+	fd := newFile(t)
+	defer syscall.Close(fd)
+
+	for _, x := range []struct {
+		h     handoff.Header
+		flags int
+	}{
+		{handoff.Header{Size: testSize, Kind: handoff.Cloned, Flags: syscall.MAP_PRIVATE}, syscall.MAP_SHARED},
+		{handoff.Header{Size: testSize, Kind: handoff.Temporal, Flags: syscall.MAP_PRIVATE}, syscall.MAP_SHARED},
+		{handoff.Header{Size: testSize, Kind: handoff.Shared, Flags: syscall.MAP_PRIVATE}, syscall.MAP_SHARED},
+		{handoff.Header{Size: testSize, Kind: handoff.Shared, Flags: syscall.MAP_SHARED}, 0},
+		{handoff.Header{Size: testSize * 2, Kind: handoff.Shared, Flags: syscall.MAP_SHARED}, syscall.MAP_SHARED},
+	} {
+		if m, err := consumer.Map(fd, x.h, syscall.PROT_READ, x.flags); err == nil {
+			m.Unmap()
+			t.Errorf("mapping accepted: %#v 0x%x", x.h, x.flags)
+		}
+	}
+}
+
+func TestFault(t *testing.T) {
+	fd := newFile(t)
+	defer syscall.Close(fd)
+
+	h := handoff.Header{
+		Size:  testSize,
+		Kind:  handoff.Shared,
+		Flags: syscall.MAP_SHARED,
+	}
+
+	m, err := consumer.Map(fd, h, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmap()
+
+	const validSize = 8192
+
+	if err := syscall.Ftruncate(fd, validSize); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := make([]byte, testSize)
+
+	n, err := m.CopyAt(dest[100:], 100)
+	if fault, ok := err.(*consumer.FaultError); !ok || fault.Offset != validSize {
+		t.Fatal(err)
+	}
+	if n != validSize-100 {
+		t.Error(n)
+	}
+
+	err = m.Visit(0, testSize, func(data []byte) error {
+		for i := range data {
+			dest[i] = data[i]
+		}
+		return nil
+	})
+	if fault, ok := err.(*consumer.FaultError); !ok || fault.Offset != validSize {
+		t.Fatal(err)
+	}
+
+	if _, err := m.ReadAt(dest[:validSize], 0); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package consumer
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"unsafe"
+)
+
+// FaultError is returned by guarded access when the memory couldn't be read,
+// typically because the producer failed.
+type FaultError struct {
+	Offset int64 // Relative to the start of the mapping.
+}
+
+func (e *FaultError) Error() string {
+	return fmt.Sprintf("consumer: memory access fault at offset %d", e.Offset)
+}
+
+// CopyAt copies memory to dest.  A fault is returned as *FaultError, with
+// the number of bytes copied before the faulting page.  The error's offset
+// is the first byte which wasn't copied.
+func (m *Mapping) CopyAt(dest []byte, offset int64) (n int, err error) {
+	err = m.Visit(offset, int64(len(dest)), func(data []byte) error {
+		// copy page by page so that progress is known when a fault occurs
+		for len(data) > 0 {
+			chunk := pagesize - int(uintptr(unsafe.Pointer(&data[0]))&uintptr(pagesize-1))
+			if chunk > len(data) {
+				chunk = len(data)
+			}
+
+			n += copy(dest[n:], data[:chunk])
+			data = data[chunk:]
+		}
+		return nil
+	})
+	if fault, ok := err.(*FaultError); ok {
+		// copy may have touched the page at any position
+		fault.Offset = offset + int64(n)
+	}
+	return
+}
+
+// ReadAt implements io.ReaderAt using CopyAt.  It can be wrapped in an
+// io.SectionReader for use with decoders.
+func (m *Mapping) ReadAt(dest []byte, offset int64) (n int, err error) {
+	if offset >= m.Header.Size {
+		err = io.EOF
+		return
+	}
+
+	if remain := m.Header.Size - offset; int64(len(dest)) > remain {
+		dest = dest[:remain]
+		err = io.EOF
+	}
+
+	n, e := m.CopyAt(dest, offset)
+	if e != nil {
+		err = e
+	}
+	return
+}
+
+// Visit a range of memory.  If a memory access fault occurs within the
+// mapping while f is running, f is aborted and *FaultError is returned.
+// Otherwise the error returned by f is returned.  f must not retain the
+// slice, and it must not start goroutines which access it.
+func (m *Mapping) Visit(offset, length int64, f func(data []byte) error) (err error) {
+	m.lock.Lock()
+	mem := m.mem
+	m.lock.Unlock()
+
+	if mem == nil {
+		return ErrUnmapped
+	}
+
+	if offset < 0 || length < 0 || offset+length > int64(len(mem)) {
+		return fmt.Errorf("consumer: range [%d, %d) is out of bounds", offset, offset+length)
+	}
+
+	return guard(mem, func() error {
+		return f(mem[offset : offset+length])
+	})
+}
+
+func guard(mem []byte, f func() error) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+
+		if fault, ok := x.(interface{ Addr() uintptr }); ok && len(mem) > 0 {
+			base := uintptr(unsafe.Pointer(&mem[0]))
+			if addr := fault.Addr(); addr >= base && addr < base+uintptr(len(mem)) {
+				err = &FaultError{Offset: int64(addr - base)}
+				return
+			}
+		}
+
+		panic(x)
+	}()
+
+	return f()
+}
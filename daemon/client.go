@@ -0,0 +1,364 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/tsavola/lazymem/handoff"
+)
+
+// ErrDisconnected is returned when the connection to the server has been
+// lost.
+var ErrDisconnected = errors.New("daemon: disconnected")
+
+type response struct {
+	h       header
+	msg     string
+	fds     []int
+	headers []handoff.Header
+	buffer  *Buffer
+}
+
+// Client of a Server.  Its methods may be called concurrently.
+type Client struct {
+	conn *net.UnixConn
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	lastId  uint32
+	pending map[uint32]chan response
+	buffers map[uint32]*Buffer
+	err     error
+}
+
+// Dial a Server.
+func Dial(path string) (c *Client, err error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return
+	}
+
+	c = &Client{
+		conn:    conn,
+		pending: make(map[uint32]chan response),
+		buffers: make(map[uint32]*Buffer),
+	}
+
+	go c.receive()
+	return
+}
+
+// Close the connection.  Buffers which haven't been finished are finished
+// by the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) receive() {
+	for {
+		var (
+			r       response
+			payload []byte
+			err     error
+		)
+
+		r.h, payload, err = readPacket(c.conn)
+		if err != nil {
+			break
+		}
+
+		r.msg = string(payload)
+
+		if r.h.op == opCreated {
+			if err = r.receiveFds(c.conn); err != nil {
+				break
+			}
+		}
+
+		c.dispatch(r)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.err = ErrDisconnected
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+	for id, b := range c.buffers {
+		b.closeOnce.Do(func() { close(b.closed) })
+		delete(c.buffers, id)
+	}
+}
+
+// receiveFds which follow an opCreated header.
+func (r *response) receiveFds(conn *net.UnixConn) (err error) {
+	if r.h.arg1 < 1 || r.h.arg1 > 2 {
+		return fmt.Errorf("daemon: invalid file descriptor count: %d", r.h.arg1)
+	}
+
+	for i := int64(0); i < r.h.arg1; i++ {
+		var (
+			fd int
+			h  handoff.Header
+		)
+
+		fd, h, err = handoff.Receive(conn)
+		if err != nil {
+			r.closeFds()
+			return
+		}
+
+		r.fds = append(r.fds, fd)
+		r.headers = append(r.headers, h)
+	}
+	return
+}
+
+func (r *response) closeFds() {
+	for _, fd := range r.fds {
+		syscall.Close(fd)
+	}
+	r.fds = nil
+}
+
+func (c *Client) dispatch(r response) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if reply := c.pending[r.h.id]; reply != nil {
+		delete(c.pending, r.h.id)
+
+		// Register the buffer before create gets the reply, so that a
+		// close notification which arrives meanwhile isn't lost.
+		if r.h.op == opCreated {
+			r.buffer = &Buffer{
+				Fd:     -1,
+				c:      c,
+				id:     r.h.id,
+				closed: make(chan struct{}),
+			}
+			c.buffers[r.h.id] = r.buffer
+		}
+
+		reply <- r
+		return
+	}
+
+	b := c.buffers[r.h.id]
+	if b == nil {
+		r.closeFds()
+		return
+	}
+
+	switch r.h.op {
+	case opClosed:
+		b.closeOnce.Do(func() { close(b.closed) })
+		delete(c.buffers, r.h.id)
+
+	case opError:
+		b.lock.Lock()
+		if b.err == nil {
+			b.err = errors.New("daemon: " + r.msg)
+		}
+		b.lock.Unlock()
+	}
+}
+
+func (c *Client) send(h header, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.conn.Write(packet(h, payload))
+	return err
+}
+
+// Create a shared buffer.  See lazymem.Manager.Create.
+func (c *Client) Create(size int64, mode int) (*Buffer, error) {
+	return c.create(handoff.Shared, size, mode)
+}
+
+// CreateCloned buffer.  See lazymem.Manager.CreateCloned.
+func (c *Client) CreateCloned(size int64, mode int) (*Buffer, error) {
+	return c.create(handoff.Cloned, size, mode)
+}
+
+// CreateTemporal buffer.  See lazymem.Manager.CreateTemporal.
+func (c *Client) CreateTemporal(size int64, mode int) (*Buffer, error) {
+	return c.create(handoff.Temporal, size, mode)
+}
+
+func (c *Client) create(kind handoff.Kind, size int64, mode int) (b *Buffer, err error) {
+	reply := make(chan response, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		err = c.err
+		c.lock.Unlock()
+		return
+	}
+	c.lastId++
+	id := c.lastId
+	c.pending[id] = reply
+	c.lock.Unlock()
+
+	err = c.send(header{op: opCreate, kind: kind, id: id, arg1: size, arg2: int64(mode)}, nil)
+	if err != nil {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return
+	}
+
+	r, ok := <-reply
+	if !ok {
+		err = ErrDisconnected
+		return
+	}
+
+	if r.h.op != opCreated {
+		err = errors.New("daemon: " + r.msg)
+		return
+	}
+
+	b = r.buffer
+
+	defer func() {
+		if err != nil {
+			r.closeFds()
+			c.forget(b)
+			b = nil
+		}
+	}()
+
+	fdCount := 2
+	if kind == handoff.Temporal {
+		fdCount = 1
+	}
+	if len(r.fds) != fdCount {
+		err = fmt.Errorf("daemon: received %d file descriptors", len(r.fds))
+		return
+	}
+
+	if h := r.headers[0]; h.Kind != kind || h.Size != size {
+		err = fmt.Errorf("daemon: received %v buffer of size %d", h.Kind, h.Size)
+		return
+	}
+
+	if fdCount == 2 {
+		b.mem, err = syscall.Mmap(r.fds[1], 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			return
+		}
+		syscall.Close(r.fds[1])
+	}
+
+	b.Fd = r.fds[0]
+	b.Header = r.headers[0]
+	return
+}
+
+func (c *Client) forget(b *Buffer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.buffers[b.id] == b {
+		delete(c.buffers, b.id)
+	}
+}
+
+// Buffer created via a Server.
+type Buffer struct {
+	// Fd is the lazymem file descriptor.  It should be passed to the
+	// consumer, and closed by the caller.
+	Fd int
+
+	// Header describes Fd.  It can be used to pass Fd on via handoff.Send.
+	Header handoff.Header
+
+	c   *Client
+	id  uint32
+	mem []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock sync.Mutex
+	err  error
+}
+
+// Bytes of a cloned or shared buffer.  Content may be written directly, and
+// it becomes available to consumers via BlocksPopulated.  Writes made by
+// consumers of a shared buffer are visible here.  Nil for temporal buffers.
+func (b *Buffer) Bytes() []byte { return b.mem }
+
+// Closed channel is closed when all consumers have closed the buffer, or
+// when the connection is lost.
+func (b *Buffer) Closed() <-chan struct{} { return b.closed }
+
+// Err returns the first asynchronous error reported by the server for this
+// buffer.
+func (b *Buffer) Err() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.err
+}
+
+// ProduceFrame of a temporal buffer, or copy data to a cloned or shared
+// buffer.  Large frames are split.
+func (b *Buffer) ProduceFrame(data []byte, offset int64) (err error) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxPayload {
+			n = maxPayload
+		}
+
+		err = b.c.send(header{op: opWrite, id: b.id, arg1: offset}, data[:n])
+		if err != nil {
+			return
+		}
+
+		data = data[n:]
+		offset += int64(n)
+	}
+	return
+}
+
+// BlocksPopulated marks adjacent 128 kB blocks of a cloned or shared buffer
+// as available for reading.  See linear.Buffer.BlocksPopulated.
+func (b *Buffer) BlocksPopulated(index, count int) error {
+	if b.Header.Kind == handoff.Temporal {
+		return errors.New("daemon: temporal buffer has no blocks")
+	}
+
+	return b.c.send(header{op: opPopulated, id: b.id, arg1: int64(index), arg2: int64(count)}, nil)
+}
+
+// Finish indicates that no more content will be provided.
+func (b *Buffer) Finish() error {
+	return b.c.send(header{op: opFinish, id: b.id}, nil)
+}
+
+// Release the buffer.  It implies Finish.  The memory returned by Bytes is
+// unmapped, and Fd is not closed.
+func (b *Buffer) Release() (err error) {
+	err = b.c.send(header{op: opRelease, id: b.id}, nil)
+
+	if b.mem != nil {
+		if e := syscall.Munmap(b.mem); err == nil {
+			err = e
+		}
+		b.mem = nil
+	}
+	return
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package daemon_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/daemon"
+	"github.com/tsavola/lazymem/handoff"
+	"github.com/tsavola/lazymem/linear"
+)
+
+type testLogger struct{ *testing.T }
+
+func (l testLogger) Printf(format string, v ...interface{}) { l.T.Logf(format, v...) }
+
+func startServer(t *testing.T) (socket string, cleanup func()) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	m, err := lazymem.New(ctx, &lazymem.Config{ErrorLog: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "lazymem-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket = path.Join(dir, "socket")
+
+	l, err := daemon.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &daemon.Server{Manager: m, ErrorLog: testLogger{t}}
+	go s.Serve(l)
+
+	cleanup = func() {
+		l.Close()
+		os.RemoveAll(dir)
+		if err := m.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}
+	return
+}
+
+func TestTemporal(t *testing.T) {
+	socket, cleanup := startServer(t)
+	defer cleanup()
+
+	c, err := daemon.Dial(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	b, err := c.CreateTemporal(int64(len(data)), syscall.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Header.Kind != handoff.Temporal || b.Header.Size != int64(len(data)) {
+		t.Errorf("header: %#v", b.Header)
+	}
+
+	go func() {
+		defer b.Finish()
+
+		if err := b.ProduceFrame(data[100000:], 100000); err != nil {
+			t.Error(err)
+		}
+		if err := b.ProduceFrame(data[:100000], 0); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	result := make([]byte, len(data))
+	if _, err := syscall.Pread(b.Fd, result, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, data) {
+		t.Error("content mismatch")
+	}
+
+	syscall.Close(b.Fd)
+
+	select {
+	case <-b.Closed():
+	case <-time.After(10 * time.Second):
+		t.Error("close notification not received")
+	}
+}
+
+func TestCloned(t *testing.T) {
+	socket, cleanup := startServer(t)
+	defer cleanup()
+
+	c, err := daemon.Dial(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	b, err := c.CreateCloned(2*linear.BlockSize, syscall.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Release()
+
+	mem := b.Bytes()
+	for i := range mem {
+		mem[i] = byte(i * 3)
+	}
+
+	if err := b.BlocksPopulated(0, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make([]byte, len(mem))
+	if _, err := syscall.Pread(b.Fd, result, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, mem) {
+		t.Error("content mismatch")
+	}
+
+	syscall.Close(b.Fd)
+
+	select {
+	case <-b.Closed():
+	case <-time.After(10 * time.Second):
+		t.Error("close notification not received")
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	socket, cleanup := startServer(t)
+	defer cleanup()
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permissions: %v", perm)
+	}
+}
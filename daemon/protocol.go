@@ -0,0 +1,112 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package daemon lets multiple processes share one lazymem filesystem.  A
+// Server owns the Manager, and producers in other processes use a Client to
+// create buffers and populate them over a Unix socket.
+//
+// The connection is a stream socket which is accessible only to the user
+// running the server.  Each packet starts with a fixed-size header, followed
+// by an optional payload.  Buffer file descriptors are returned after the
+// opCreated header using the handoff package's wire format.  The cloned and
+// shared buffers are backed by memory files, which are also returned to the
+// client so that it can populate them directly.
+package daemon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tsavola/lazymem/handoff"
+)
+
+const (
+	opCreate    = 1 // client: kind, id, size, mode
+	opWrite     = 2 // client: id, offset, payload
+	opPopulated = 3 // client: id, block index, block count
+	opFinish    = 4 // client: id
+	opRelease   = 5 // client: id
+	opCreated   = 6 // server: id, file descriptor count; followed by handoff messages
+	opError     = 7 // server: id, payload message
+	opClosed    = 8 // server: id
+)
+
+const (
+	headerLen  = 28
+	maxPayload = 65536
+)
+
+type header struct {
+	op     uint8
+	kind   handoff.Kind
+	id     uint32
+	arg1   int64
+	arg2   int64
+	length uint32 // of payload
+}
+
+func (h *header) marshal(b []byte) {
+	b[0] = h.op
+	b[1] = uint8(h.kind)
+	binary.LittleEndian.PutUint16(b[2:], 0)
+	binary.LittleEndian.PutUint32(b[4:], h.id)
+	binary.LittleEndian.PutUint64(b[8:], uint64(h.arg1))
+	binary.LittleEndian.PutUint64(b[16:], uint64(h.arg2))
+	binary.LittleEndian.PutUint32(b[24:], h.length)
+}
+
+func (h *header) unmarshal(b []byte) error {
+	h.op = b[0]
+	h.kind = handoff.Kind(b[1])
+	h.id = binary.LittleEndian.Uint32(b[4:])
+	h.arg1 = int64(binary.LittleEndian.Uint64(b[8:]))
+	h.arg2 = int64(binary.LittleEndian.Uint64(b[16:]))
+	h.length = binary.LittleEndian.Uint32(b[24:])
+
+	if h.length > maxPayload {
+		return fmt.Errorf("daemon: payload is too long: %d bytes", h.length)
+	}
+	return nil
+}
+
+// readPacket reads exactly one packet, so that handoff messages may follow
+// it on the connection.
+func readPacket(r io.Reader) (h header, payload []byte, err error) {
+	b := make([]byte, headerLen)
+
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return
+	}
+
+	err = h.unmarshal(b)
+	if err != nil {
+		return
+	}
+
+	payload = make([]byte, h.length)
+
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+func packet(h header, payload []byte) []byte {
+	b := make([]byte, headerLen+len(payload))
+	h.length = uint32(len(payload))
+	h.marshal(b)
+	copy(b[headerLen:], payload)
+	return b
+}
+
+// DefaultSocket location: $XDG_RUNTIME_DIR/lazymem/daemon.sock, or under
+// /run/user/UID if XDG_RUNTIME_DIR is not set.
+func DefaultSocket() string {
+	runDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runDir == "" {
+		runDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return runDir + "/lazymem/daemon.sock"
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/handoff"
+	"github.com/tsavola/lazymem/linear"
+	"github.com/tsavola/lazymem/sparse"
+)
+
+// Server creates buffers on behalf of clients.  Only clients running as the
+// same user as the server are served.
+type Server struct {
+	Manager  *lazymem.Manager
+	ErrorLog lazymem.Logger
+}
+
+// Listen on a Unix socket suitable for Serve.  The socket is made accessible
+// only to the current user.
+func Listen(path string) (l *net.UnixListener, err error) {
+	l, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		l = nil
+	}
+	return
+}
+
+// Serve clients until the listener is closed.
+func (s *Server) Serve(l *net.UnixListener) error {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+type serverBuffer struct {
+	sparse *sparse.Buffer
+	linear *linear.Buffer
+}
+
+func (b *serverBuffer) finish() {
+	if b.sparse != nil {
+		b.sparse.ProductionFinished()
+	} else {
+		b.linear.PopulationFinished()
+	}
+}
+
+type serverConn struct {
+	*Server
+	conn *net.UnixConn
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	buffers map[uint32]*serverBuffer
+}
+
+func (s *Server) serveConn(conn *net.UnixConn) {
+	if err := checkPeer(conn); err != nil {
+		s.logf("%v", err)
+		conn.Close()
+		return
+	}
+
+	c := &serverConn{
+		Server:  s,
+		conn:    conn,
+		buffers: make(map[uint32]*serverBuffer),
+	}
+
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		// consumers get EOF instead of waiting forever
+		for id, b := range c.buffers {
+			b.finish()
+			delete(c.buffers, id)
+		}
+
+		conn.Close()
+	}()
+
+	for {
+		h, payload, err := readPacket(conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				c.logf("%v", err)
+			}
+			return
+		}
+
+		if err := c.handle(h, payload); err != nil {
+			c.reply(header{op: opError, id: h.id}, []byte(err.Error()))
+		}
+	}
+}
+
+// checkPeer credentials, as the socket may have been accessible to others
+// between its creation and Listen's chmod.
+func checkPeer(conn *net.UnixConn) (err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var cred *syscall.Ucred
+
+	if e := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+
+	if cred.Uid != uint32(os.Geteuid()) {
+		err = fmt.Errorf("rejected client with uid %d (pid %d)", cred.Uid, cred.Pid)
+	}
+	return
+}
+
+func (c *serverConn) handle(h header, payload []byte) (err error) {
+	if h.op == opCreate {
+		return c.create(h)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b := c.buffers[h.id]
+	if b == nil {
+		return fmt.Errorf("unknown buffer id: %d", h.id)
+	}
+
+	switch h.op {
+	case opWrite:
+		if b.sparse != nil {
+			b.sparse.ProduceFrame(append([]byte(nil), payload...), h.arg1)
+		} else {
+			mem := b.linear.Bytes()
+			if h.arg1 < 0 || h.arg1+int64(len(payload)) > int64(len(mem)) {
+				return errors.New("write out of bounds")
+			}
+			copy(mem[h.arg1:], payload)
+		}
+
+	case opPopulated:
+		if b.linear == nil {
+			return errors.New("temporal buffer has no blocks")
+		}
+		blocks := int64(b.linear.Len()+linear.BlockSize-1) / linear.BlockSize
+		if h.arg1 < 0 || h.arg2 < 0 || h.arg1+h.arg2 > blocks {
+			return errors.New("block index or count out of bounds")
+		}
+		b.linear.BlocksPopulated(int(h.arg1), int(h.arg2))
+
+	case opFinish:
+		b.finish()
+
+	case opRelease:
+		b.finish()
+		delete(c.buffers, h.id)
+
+	default:
+		return fmt.Errorf("unknown op: %d", h.op)
+	}
+
+	return nil
+}
+
+func (c *serverConn) create(h header) (err error) {
+	c.lock.Lock()
+	_, exists := c.buffers[h.id]
+	c.lock.Unlock()
+	if exists {
+		return fmt.Errorf("buffer id already in use: %d", h.id)
+	}
+
+	size, mode := h.arg1, int(h.arg2)
+	if size <= 0 || int64(int(size)) != size {
+		return fmt.Errorf("invalid size: %d", size)
+	}
+
+	b := new(serverBuffer)
+
+	var (
+		fd     int
+		closed <-chan struct{}
+	)
+
+	switch h.kind {
+	case handoff.Temporal:
+		b.sparse = sparse.NewBuffer()
+		life := lazymem.NewLifecycle(context.Background())
+		closed = life.Context().Done()
+
+		fd, err = c.Manager.CreateTemporal(size, mode, struct {
+			*sparse.Buffer
+			*lazymem.Lifecycle
+		}{b.sparse, life})
+		if err != nil {
+			return
+		}
+
+	case handoff.Cloned, handoff.Shared:
+		b.linear, err = linear.NewMemfdBuffer("lazymem-daemon", int(size))
+		if err != nil {
+			return
+		}
+
+		if h.kind == handoff.Shared {
+			fd, err = c.Manager.Create(size, mode, b.linear)
+		} else {
+			fd, err = c.Manager.CreateCloned(size, mode, b.linear)
+		}
+		if err != nil {
+			b.linear.Free()
+			return
+		}
+
+		closed = b.linear.Closed()
+
+	default:
+		return fmt.Errorf("invalid buffer kind: %d", h.kind)
+	}
+
+	c.lock.Lock()
+	c.buffers[h.id] = b
+	c.lock.Unlock()
+
+	go c.watchClose(h.id, b, closed)
+
+	c.replyCreated(h.id, size, h.kind, fd, b.linear)
+	syscall.Close(fd)
+	return
+}
+
+// watchClose notifies the client and releases the memory when the consumers
+// are done with the buffer.  The client's mapping of the memory file stays
+// valid.
+func (c *serverConn) watchClose(id uint32, b *serverBuffer, closed <-chan struct{}) {
+	<-closed
+
+	c.lock.Lock()
+	if c.buffers[id] == b {
+		delete(c.buffers, id)
+	}
+	c.lock.Unlock()
+
+	b.finish()
+	if b.linear != nil {
+		b.linear.Free()
+	}
+
+	c.reply(header{op: opClosed, id: id}, nil)
+}
+
+func (c *serverConn) reply(h header, payload []byte) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.check(c.write(h, payload))
+}
+
+// replyCreated sends the buffer file descriptor, and the memory file of a
+// cloned or shared buffer.
+func (c *serverConn) replyCreated(id uint32, size int64, kind handoff.Kind, fd int, mem *linear.Buffer) {
+	count := int64(1)
+	if mem != nil {
+		count++
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err := c.write(header{op: opCreated, id: id, arg1: count}, nil)
+	if err == nil {
+		err = handoff.Send(c.conn, fd, handoff.Header{
+			Size:  size,
+			Kind:  kind,
+			Flags: handoff.KindFlags(kind),
+		})
+	}
+	if err == nil && mem != nil {
+		err = handoff.Send(c.conn, mem.Fd(), handoff.Header{
+			Size:  size,
+			Kind:  handoff.Shared,
+			Flags: syscall.MAP_SHARED,
+		})
+	}
+	c.check(err)
+}
+
+func (c *serverConn) write(h header, payload []byte) (err error) {
+	_, err = c.conn.Write(packet(h, payload))
+	return
+}
+
+func (c *serverConn) check(err error) {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		c.logf("reply: %v", err)
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf("lazymem daemon: "+format, args...)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package evict releases the memory of cold linear buffer blocks under a
+// memory budget or cgroup memory pressure.  The buffers must have a
+// Refetcher; see linear.Buffer.SetRefetcher.
+package evict
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsavola/lazymem/linear"
+)
+
+// Config of an Evictor.  The zero value evicts nothing.
+type Config struct {
+	// Budget limits the total size of populated blocks of the tracked
+	// buffers, in bytes.  Zero means unlimited.
+	Budget int64
+
+	// PressureFile is a cgroup v2 memory.pressure file.  If set, blocks are
+	// evicted while its "some avg10" value exceeds PressureThreshold.  See
+	// CgroupPressureFile.
+	PressureFile string
+
+	// PressureThreshold in percent.  Defaults to 10.
+	PressureThreshold float64
+
+	// PressureFraction of populated blocks is evicted per interval under
+	// pressure.  Defaults to 1/8.
+	PressureFraction float64
+
+	// Interval between checks made by Run.  Defaults to one second.
+	Interval time.Duration
+}
+
+// Evictor tracks buffers.
+type Evictor struct {
+	Config
+
+	lock    sync.Mutex
+	buffers []*linear.Buffer
+	next    int
+}
+
+func New(config Config) (e *Evictor) {
+	e = &Evictor{Config: config}
+
+	if e.PressureThreshold <= 0 {
+		e.PressureThreshold = 10
+	}
+	if e.PressureFraction <= 0 {
+		e.PressureFraction = 1.0 / 8
+	}
+	if e.Interval <= 0 {
+		e.Interval = time.Second
+	}
+	return
+}
+
+// Add a buffer.  It is removed when it's closed.
+func (e *Evictor) Add(b *linear.Buffer) {
+	e.lock.Lock()
+	e.buffers = append(e.buffers, b)
+	e.lock.Unlock()
+
+	go func() {
+		<-b.Closed()
+		e.remove(b)
+	}()
+}
+
+func (e *Evictor) remove(b *linear.Buffer) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for i, x := range e.buffers {
+		if x == b {
+			e.buffers = append(e.buffers[:i], e.buffers[i+1:]...)
+			if e.next > i {
+				e.next--
+			}
+			return
+		}
+	}
+}
+
+// Run Collect periodically until the context is done.
+func (e *Evictor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := e.Collect(); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Collect evicts blocks if the budget is exceeded or if there is memory
+// pressure.  The buffers are visited in round-robin order.  It returns the
+// number of evicted blocks.
+func (e *Evictor) Collect() (evicted int, err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var populated int64
+	for _, b := range e.buffers {
+		populated += int64(b.PopulatedBlocks())
+	}
+
+	var target int64
+
+	if e.Budget > 0 {
+		if excess := populated*linear.BlockSize - e.Budget; excess > 0 {
+			target = (excess + linear.BlockSize - 1) / linear.BlockSize
+		}
+	}
+
+	if e.PressureFile != "" {
+		var pressure float64
+
+		pressure, err = ReadPressure(e.PressureFile)
+		if err != nil {
+			return
+		}
+
+		if pressure > e.PressureThreshold {
+			n := int64(float64(populated) * e.PressureFraction)
+			if n == 0 {
+				n = 1
+			}
+			if n > target {
+				target = n
+			}
+		}
+	}
+
+	for i := 0; i < len(e.buffers) && int64(evicted) < target; i++ {
+		b := e.buffers[e.next]
+		e.next = (e.next + 1) % len(e.buffers)
+
+		var n int
+
+		n, err = b.EvictBlocks(int(target) - evicted)
+		evicted += n
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ReadPressure returns the "some avg10" value of a pressure stall
+// information file.
+func ReadPressure(filename string) (avg10 float64, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "avg10=") {
+				return strconv.ParseFloat(field[len("avg10="):], 64)
+			}
+		}
+	}
+
+	err = s.Err()
+	if err == nil {
+		err = fmt.Errorf("evict: no avg10 value in %s", filename)
+	}
+	return
+}
+
+// CgroupPressureFile returns the memory.pressure file of the cgroup v2 of
+// the current process.
+func CgroupPressureFile() (filename string, err error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			filename = "/sys/fs/cgroup" + strings.TrimSuffix(line[3:], "/") + "/memory.pressure"
+			return
+		}
+	}
+
+	err = fmt.Errorf("evict: cgroup v2 not found")
+	return
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package evict_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tsavola/lazymem/evict"
+	"github.com/tsavola/lazymem/linear"
+)
+
+const blocks = 4
+
+func newBuffer(t *testing.T) (b *linear.Buffer, data []byte, fetches *int32) {
+	data = make([]byte, blocks*linear.BlockSize)
+	for i := range data {
+		data[i] = byte(i * 5)
+	}
+
+	b, err := linear.NewMappedBuffer(len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches = new(int32)
+	b.SetRefetcher(func(target []byte, index int) error {
+		atomic.AddInt32(fetches, 1)
+		copy(target, data[index*linear.BlockSize:])
+		return nil
+	})
+
+	copy(b.Bytes(), data)
+	b.BlocksPopulated(0, blocks)
+	b.PopulationFinished()
+	return
+}
+
+func TestBudget(t *testing.T) {
+	b, data, fetches := newBuffer(t)
+	defer b.Free()
+
+	e := evict.New(evict.Config{Budget: 2 * linear.BlockSize})
+	e.Add(b)
+
+	n, err := e.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || b.PopulatedBlocks() != 2 {
+		t.Errorf("evicted %d, populated %d", n, b.PopulatedBlocks())
+	}
+
+	result := make([]byte, len(data))
+	if _, err := b.ReadAt(result, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, data) {
+		t.Error("content mismatch")
+	}
+	if n := atomic.LoadInt32(fetches); n != 2 {
+		t.Errorf("%d fetches", n)
+	}
+
+	// Everything was just read.
+	if n, _ := e.Collect(); n != 0 {
+		t.Errorf("evicted %d recently read blocks", n)
+	}
+	if n, _ := e.Collect(); n != 2 {
+		t.Errorf("evicted %d blocks", n)
+	}
+}
+
+func TestPressure(t *testing.T) {
+	b, _, _ := newBuffer(t)
+	defer b.Free()
+
+	filename := filepath.Join(t.TempDir(), "memory.pressure")
+	content := "some avg10=42.50 avg60=1.00 avg300=0.00 total=1234\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := evict.New(evict.Config{PressureFile: filename, PressureFraction: 0.5})
+	e.Add(b)
+
+	if n, err := e.Collect(); err != nil || n != 2 {
+		t.Errorf("evicted %d: %v", n, err)
+	}
+
+	content = "some avg10=1.00 avg60=1.00 avg300=0.00 total=1234\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := e.Collect(); err != nil || n != 0 {
+		t.Errorf("evicted %d without pressure: %v", n, err)
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"context"
 	cryptorand "crypto/rand"
 	"encoding/binary"
+	"io"
+	"log/slog"
 	mathrand "math/rand"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jacobsa/fuse"
@@ -30,18 +33,25 @@ var (
 
 type fileSystem struct {
 	fuseutil.NotImplementedFileSystem
-	uid uint32
-	gid uint32
-
-	lock   sync.Mutex
-	nodes  map[fuseops.InodeID]buffer
-	names  map[string]fuseops.InodeID
-	lastId fuseops.InodeID
-	rand   *mathrand.Rand
-	pages  uint64
+	pages   quota // first for atomic alignment
+	buffers quota
+	closing int32 // atomic
+	failed  int32 // atomic
+	abort   context.Context
+	cancel  context.CancelFunc // aborts pending reads
+	uid     uint32
+	gid     uint32
+	log     *slog.Logger
+	stall   time.Duration
+	quiet   bool // log read problems at debug level
+	nodes   inodeTable
+
+	nameLock sync.Mutex
+	names    map[string]fuseops.InodeID
+	rand     *mathrand.Rand
 }
 
-func newFileSystem() (fs *fileSystem, err error) {
+func newFileSystem(log *slog.Logger, c *Config) (fs *fileSystem, err error) {
 	var seed int64
 
 	err = binary.Read(cryptorand.Reader, binary.LittleEndian, &seed)
@@ -50,47 +60,154 @@ func newFileSystem() (fs *fileSystem, err error) {
 	}
 
 	fs = &fileSystem{
-		uid:    uint32(os.Getuid()),
-		gid:    uint32(os.Getgid()),
-		nodes:  make(map[fuseops.InodeID]buffer),
-		names:  make(map[string]fuseops.InodeID),
-		lastId: fuseops.RootInodeID,
-		rand:   mathrand.New(mathrand.NewSource(seed)),
+		pages:   quota{limit: c.MaxPages},
+		buffers: quota{limit: c.MaxBuffers},
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		log:     log,
+		stall:   c.StallThreshold,
+		quiet:   c.LogHandler == nil,
+		names:   make(map[string]fuseops.InodeID),
+		rand:    mathrand.New(mathrand.NewSource(seed)),
 	}
+	fs.abort, fs.cancel = context.WithCancel(context.Background())
+	fs.nodes.init(fuseops.RootInodeID)
 	return
 }
 
-func (fs *fileSystem) registerBuffer(b buffer) (id fuseops.InodeID, name string) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+func (fs *fileSystem) registerBuffer(b buffer) (id fuseops.InodeID, name string, err error) {
+	if atomic.LoadInt32(&fs.closing) != 0 {
+		err = ErrShutdown
+		return
+	}
+
+	err = fs.buffers.reserve("buffers", 1)
+	if err != nil {
+		return
+	}
+
+	err = fs.pages.reserve("pages", b.pages())
+	if err != nil {
+		fs.buffers.release(1)
+		return
+	}
+
+	id = fs.nodes.insert(b)
+	name = fs.registerName(id)
+	fs.log.LogAttrs(context.Background(), slog.LevelDebug, "buffer created", nodeAttrs(id, &b)...)
+	return
+}
+
+// registerBufferName makes an existing buffer accessible via a new name.
+func (fs *fileSystem) registerBufferName(id fuseops.InodeID) (name string, found bool) {
+	if fs.nodes.lookup(id) == nil {
+		return
+	}
+
+	name = fs.registerName(id)
+	found = true
+	return
+}
+
+func (fs *fileSystem) registerName(id fuseops.InodeID) (name string) {
+	fs.nameLock.Lock()
+	defer fs.nameLock.Unlock()
 
-	id = fs.lastId + 1
 	name = strconv.FormatUint(fs.rand.Uint64(), 36)
 
 	if _, exists := fs.names[name]; exists {
 		panic(name)
 	}
 
-	fs.nodes[id] = b
 	fs.names[name] = id
-	fs.lastId = id
-	fs.pages += countPages(b.size)
+	return
+}
+
+func (fs *fileSystem) lookupBuffer(id fuseops.InodeID) (b buffer, found bool) {
+	if n := fs.nodes.lookup(id); n != nil {
+		b = n.buffer
+		found = true
+	}
 	return
 }
 
 func (fs *fileSystem) forgetBufferName(name string) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	fs.nameLock.Lock()
+	defer fs.nameLock.Unlock()
 
 	delete(fs.names, name)
 }
 
+// forgetBufferNode removes the node when it has no handles.  A view may hold
+// a handle after the kernel has forgotten the inode; then the node is removed
+// when the view releases it.
 func (fs *fileSystem) forgetBufferNode(id fuseops.InodeID) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	n := fs.nodes.lookup(id)
+	if n == nil {
+		return
+	}
+
+	atomic.StoreInt32(&n.forgotten, 1)
+	if atomic.LoadInt32(&n.handles) == 0 {
+		fs.removeNode(id)
+	}
+}
+
+// removeNode may be called more than once.
+func (fs *fileSystem) removeNode(id fuseops.InodeID) {
+	n := fs.nodes.remove(id)
+	if n == nil {
+		return
+	}
+
+	n.forget()
+	fs.uncharge(n)
+	fs.log.LogAttrs(context.Background(), slog.LevelDebug, "buffer forgotten", nodeAttrs(id, &n.buffer)...)
+}
+
+// shutdown prevents buffer registration.
+func (fs *fileSystem) shutdown() {
+	atomic.StoreInt32(&fs.closing, 1)
+}
 
-	fs.pages -= countPages(fs.nodes[id].size)
-	delete(fs.nodes, id)
+// resume buffer registration after a failed shutdown.
+func (fs *fileSystem) resume() {
+	atomic.StoreInt32(&fs.closing, 0)
+}
+
+// fail subsequent reads and writes.  Reads which are waiting for content are
+// failed if the buffer supports it (see contextReader).
+func (fs *fileSystem) fail() {
+	atomic.StoreInt32(&fs.failed, 1)
+	fs.cancel()
+}
+
+// waitForRelease of all buffers.  It returns the number of buffers still in
+// use when the context is done.
+func (fs *fileSystem) waitForRelease(ctx context.Context, poll time.Duration) (live uint64) {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		live = fs.buffers.load()
+		if live == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (fs *fileSystem) uncharge(n *node) {
+	if atomic.CompareAndSwapInt32(&n.charged, 1, 0) {
+		fs.pages.release(n.pages())
+		fs.buffers.release(1)
+	}
 }
 
 func (fs *fileSystem) bufferAttributes(size int64) fuseops.InodeAttributes {
@@ -103,33 +220,39 @@ func (fs *fileSystem) bufferAttributes(size int64) fuseops.InodeAttributes {
 }
 
 func (fs *fileSystem) StatFS(ctx context.Context, op *fuseops.StatFSOp) (err error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-
 	op.BlockSize = uint32(pagesize)
-	op.Blocks = uint64(fs.pages)
+	op.Blocks, op.BlocksFree = fs.pages.stat()
+	op.BlocksAvailable = op.BlocksFree
 	op.IoSize = statIoSize
-	op.Inodes = uint64(len(fs.nodes)) + 1
+	op.Inodes, op.InodesFree = fs.buffers.stat()
+	op.Inodes++ // root
 	return
 }
 
 func (fs *fileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) (err error) {
+	ctx, task, region := startTrace(ctx, "LookUpInode")
+	defer endTrace(task, region)
+
 	if op.Parent != fuseops.RootInodeID {
 		return fuse.ENOENT
 	}
 
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-
+	fs.nameLock.Lock()
 	id, found := fs.names[op.Name]
+	fs.nameLock.Unlock()
 	if !found {
 		return fuse.ENOENT
 	}
 
-	b := fs.nodes[id]
+	traceInode(ctx, id)
+
+	n := fs.nodes.lookup(id)
+	if n == nil {
+		return fuse.ENOENT
+	}
 
 	op.Entry.Child = id
-	op.Entry.Attributes = fs.bufferAttributes(b.size)
+	op.Entry.Attributes = fs.bufferAttributes(n.size)
 	op.Entry.AttributesExpiration = never
 	return
 }
@@ -142,14 +265,12 @@ func (fs *fileSystem) GetInodeAttributes(ctx context.Context, op *fuseops.GetIno
 			Gid:  fs.gid,
 		}
 	} else {
-		fs.lock.Lock()
-		b, found := fs.nodes[op.Inode]
-		fs.lock.Unlock()
-		if !found {
+		n := fs.nodes.lookup(op.Inode)
+		if n == nil {
 			return fuse.ENOENT
 		}
 
-		op.Attributes = fs.bufferAttributes(b.size)
+		op.Attributes = fs.bufferAttributes(n.size)
 	}
 
 	op.AttributesExpiration = never
@@ -161,47 +282,95 @@ func (fs *fileSystem) SetInodeAttributes(context.Context, *fuseops.SetInodeAttri
 }
 
 func (fs *fileSystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err error) {
-	fs.lock.Lock()
-	_, found := fs.nodes[op.Inode]
-	fs.lock.Unlock()
-	if !found {
+	n := fs.nodes.lookup(op.Inode)
+	if n == nil {
 		return fuse.EIO
 	}
 
+	handles := atomic.AddInt32(&n.handles, 1)
+	fs.log.LogAttrs(ctx, slog.LevelDebug, "buffer opened", nodeAttrs(op.Inode, &n.buffer, slog.Int("handles", int(handles)))...)
+
+	if n.hooks != nil {
+		n.hooks.BufferOpened()
+	}
+
 	op.Handle = fuseops.HandleID(op.Inode)
-	op.KeepPageCache = true
+	op.KeepPageCache = atomic.LoadInt32(&n.invalidating) == 0
 	return
 }
 
 func (fs *fileSystem) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
-	fs.lock.Lock()
-	b, found := fs.nodes[op.Inode]
-	fs.lock.Unlock()
-	if !found {
+	ctx, task, region := traceOp(ctx, "ReadFile", op.Inode)
+	defer endTrace(task, region)
+	defer func() { traceError(ctx, err) }()
+	traceRange(ctx, op.Offset, len(op.Dst))
+
+	n := fs.nodes.lookup(op.Inode)
+	if n == nil {
 		return fuse.ENOENT
 	}
 
-	op.BytesRead, err = b.readAt(adjustLen(op.Dst, op.Offset, b.size), op.Offset)
+	if atomic.LoadInt32(&fs.failed) != 0 {
+		return fuse.EIO
+	}
+
+	// The op's context is canceled when the kernel interrupts the request,
+	// which happens also when a Go program faulting in the page gets a
+	// preemption signal.  Reads are aborted only when the filesystem fails.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(fs.abort, cancel)
+	defer stop()
+
+	dst := adjustLen(op.Dst, op.Offset, n.size)
+	t0 := time.Now()
+
+	op.BytesRead, err = n.readAt(ctx, dst, op.Offset)
+
+	if err != nil && fs.abort.Err() != nil {
+		err = fuse.EIO
+	}
+
+	if d := time.Since(t0); d >= fs.stall {
+		fs.logRead(ctx, slog.LevelWarn, "read stalled", op, n, len(dst), slog.Duration("duration", d))
+	}
+	if err != nil && err != io.EOF {
+		fs.logRead(ctx, slog.LevelError, "read error", op, n, len(dst), slog.String("error", err.Error()))
+	}
 	return
 }
 
+func (fs *fileSystem) logRead(ctx context.Context, level slog.Level, msg string, op *fuseops.ReadFileOp, n *node, length int, attr slog.Attr) {
+	if fs.quiet {
+		// ErrorLog didn't use to get these
+		level = slog.LevelDebug
+	}
+
+	attrs := nodeAttrs(op.Inode, &n.buffer, slog.Int64(LogKeyOffset, op.Offset), slog.Int(LogKeyLength, length), attr)
+	fs.log.LogAttrs(ctx, level, msg, attrs...)
+}
+
 func (fs *fileSystem) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) (err error) {
-	fs.lock.Lock()
-	b, found := fs.nodes[op.Inode]
-	fs.lock.Unlock()
-	if !found {
+	ctx, task, region := traceOp(ctx, "WriteFile", op.Inode)
+	defer endTrace(task, region)
+	defer func() { traceError(ctx, err) }()
+	traceRange(ctx, op.Offset, len(op.Data))
+
+	n := fs.nodes.lookup(op.Inode)
+	if n == nil {
 		return fuse.ENOENT
 	}
 
-	_, err = b.writeAt(adjustLen(op.Data, op.Offset, b.size), op.Offset)
+	if atomic.LoadInt32(&fs.failed) != 0 {
+		return fuse.EIO
+	}
+
+	_, err = n.writeAt(adjustLen(op.Data, op.Offset, n.size), op.Offset)
 	return
 }
 
 func (fs *fileSystem) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) (err error) {
-	fs.lock.Lock()
-	_, found := fs.nodes[op.Inode]
-	fs.lock.Unlock()
-	if !found {
+	if fs.nodes.lookup(op.Inode) == nil {
 		return fuse.ENOENT
 	}
 
@@ -209,18 +378,54 @@ func (fs *fileSystem) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) (e
 }
 
 func (fs *fileSystem) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) (err error) {
-	fs.lock.Lock()
-	b, found := fs.nodes[fuseops.InodeID(op.Handle)]
-	fs.lock.Unlock()
-	if !found {
+	ctx, task, region := traceOp(ctx, "ReleaseFileHandle", fuseops.InodeID(op.Handle))
+	defer endTrace(task, region)
+	defer func() { traceError(ctx, err) }()
+
+	n := fs.nodes.lookup(fuseops.InodeID(op.Handle))
+	if n == nil {
 		return fuse.ENOENT
 	}
 
-	err = b.close()
+	return fs.releaseNode(ctx, fuseops.InodeID(op.Handle), n)
+}
+
+// holdNode acquires a handle without opening a file.  The node must have
+// other handles.
+func (fs *fileSystem) holdNode(id fuseops.InodeID) (n *node) {
+	n = fs.nodes.lookup(id)
+	if n != nil {
+		atomic.AddInt32(&n.handles, 1)
+	}
+	return
+}
+
+func (fs *fileSystem) releaseNode(ctx context.Context, id fuseops.InodeID, n *node) (err error) {
+	handles := atomic.AddInt32(&n.handles, -1)
+	fs.log.LogAttrs(ctx, slog.LevelDebug, "buffer released", nodeAttrs(id, &n.buffer, slog.Int("handles", int(handles)))...)
+
+	// The buffer is closed when its last handle is released.  It can't be
+	// opened again, so it doesn't count against quotas even though the
+	// kernel may not forget the inode for a while.
+	if handles == 0 {
+		err = n.close()
+		fs.uncharge(n)
+
+		if n.hooks != nil {
+			n.hooks.BufferReleased()
+		}
+
+		if atomic.LoadInt32(&n.forgotten) != 0 {
+			fs.removeNode(id)
+		}
+	}
 	return
 }
 
 func (fs *fileSystem) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) (err error) {
+	_, task, region := traceOp(ctx, "ForgetInode", op.Inode)
+	defer endTrace(task, region)
+
 	if op.Inode != fuseops.RootInodeID {
 		fs.forgetBufferNode(op.Inode)
 	}
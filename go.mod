@@ -1,3 +1,5 @@
 module github.com/tsavola/lazymem
 
+go 1.21
+
 require github.com/jacobsa/fuse v0.0.0-20180417054321-cd3959611bcb
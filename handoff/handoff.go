@@ -0,0 +1,235 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package handoff transfers lazymem file descriptors between processes over
+// Unix sockets, together with metadata which describes how they may be
+// mapped.
+package handoff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Kind of buffer behind a file descriptor.
+type Kind uint8
+
+const (
+	Shared   Kind = 1 // Manager.Create
+	Cloned   Kind = 2 // Manager.CreateCloned
+	Temporal Kind = 3 // Manager.CreateTemporal
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Shared:
+		return "shared"
+	case Cloned:
+		return "cloned"
+	case Temporal:
+		return "temporal"
+	default:
+		return fmt.Sprintf("Kind(%d)", uint8(k))
+	}
+}
+
+// MaxLabelLen is the maximum length of Header.Label.
+const MaxLabelLen = 255
+
+const (
+	magic       = "LZMH"
+	version     = 1
+	fixedLen    = 4 + 1 + 1 + 2 + 4 + 8 // magic, version, kind, label length, flags, size
+	maxTotalLen = fixedLen + MaxLabelLen
+)
+
+// Header describes a transferred file descriptor.
+type Header struct {
+	Size  int64  // Mapping length.
+	Kind  Kind   // Determines which mapping flags are possible.
+	Flags int    // Allowed mapping flags: syscall.MAP_SHARED and/or MAP_PRIVATE.
+	Label string // Application-specific.
+}
+
+// KindFlags returns the mapping flags which a buffer kind supports.
+func KindFlags(kind Kind) int {
+	switch kind {
+	case Shared:
+		return syscall.MAP_SHARED | syscall.MAP_PRIVATE
+	case Cloned, Temporal:
+		return syscall.MAP_PRIVATE
+	default:
+		return 0
+	}
+}
+
+// Validate checks that the header is self-consistent.
+func (h *Header) Validate() error {
+	if h.Size <= 0 {
+		return fmt.Errorf("handoff: invalid size: %d", h.Size)
+	}
+
+	supported := KindFlags(h.Kind)
+	if supported == 0 {
+		return fmt.Errorf("handoff: invalid kind: %v", h.Kind)
+	}
+
+	if h.Flags == 0 || h.Flags&^supported != 0 {
+		return fmt.Errorf("handoff: mapping flags 0x%x not supported by %v buffer", h.Flags, h.Kind)
+	}
+
+	if len(h.Label) > MaxLabelLen {
+		return errors.New("handoff: label is too long")
+	}
+
+	return nil
+}
+
+func (h *Header) marshal() []byte {
+	b := make([]byte, fixedLen+len(h.Label))
+	copy(b, magic)
+	b[4] = version
+	b[5] = byte(h.Kind)
+	binary.LittleEndian.PutUint16(b[6:], uint16(len(h.Label)))
+	binary.LittleEndian.PutUint32(b[8:], uint32(h.Flags))
+	binary.LittleEndian.PutUint64(b[12:], uint64(h.Size))
+	copy(b[fixedLen:], h.Label)
+	return b
+}
+
+func (h *Header) unmarshalFixed(b []byte) (labelLen int, err error) {
+	if string(b[:4]) != magic {
+		err = errors.New("handoff: bad magic")
+		return
+	}
+	if b[4] != version {
+		err = fmt.Errorf("handoff: unsupported version: %d", b[4])
+		return
+	}
+
+	h.Kind = Kind(b[5])
+	labelLen = int(binary.LittleEndian.Uint16(b[6:]))
+	h.Flags = int(binary.LittleEndian.Uint32(b[8:]))
+	h.Size = int64(binary.LittleEndian.Uint64(b[12:]))
+
+	if labelLen > MaxLabelLen {
+		err = errors.New("handoff: label is too long")
+	}
+	return
+}
+
+// Send a file descriptor and its header.  The file descriptor is duplicated
+// by the transfer; the caller may close it afterwards.
+func Send(conn *net.UnixConn, fd int, h Header) (err error) {
+	err = h.Validate()
+	if err != nil {
+		return
+	}
+
+	data := h.marshal()
+
+	n, _, err := conn.WriteMsgUnix(data, syscall.UnixRights(fd), nil)
+	if err != nil {
+		return
+	}
+
+	if n < len(data) {
+		_, err = conn.Write(data[n:])
+	}
+	return
+}
+
+// Receive a file descriptor and its header.  The header has been validated.
+// The file descriptor has the close-on-exec flag set.  Exactly one message is
+// consumed, so that the connection may also carry other data.  It must be a
+// stream socket.
+func Receive(conn *net.UnixConn) (fd int, h Header, err error) {
+	fd = -1
+
+	data := make([]byte, maxTotalLen)
+	oob := make([]byte, syscall.CmsgSpace(4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(data[:fixedLen], oob)
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		err = io.EOF
+		return
+	}
+
+	fd, err = parseRights(oob[:oobn])
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			syscall.Close(fd)
+			fd = -1
+		}
+	}()
+
+	_, err = io.ReadFull(conn, data[n:fixedLen])
+	if err != nil {
+		return
+	}
+
+	labelLen, err := h.unmarshalFixed(data)
+	if err != nil {
+		return
+	}
+
+	label := data[fixedLen : fixedLen+labelLen]
+
+	_, err = io.ReadFull(conn, label)
+	if err != nil {
+		return
+	}
+
+	h.Label = string(label)
+
+	err = h.Validate()
+	return
+}
+
+func parseRights(oob []byte) (fd int, err error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+
+	var fds []int
+
+	for i := range msgs {
+		var more []int
+
+		more, err = syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			closeAll(fds)
+			return
+		}
+
+		fds = append(fds, more...)
+	}
+
+	if len(fds) != 1 {
+		closeAll(fds)
+		err = fmt.Errorf("handoff: expected 1 file descriptor, received %d", len(fds))
+		return
+	}
+
+	fd = fds[0]
+	syscall.CloseOnExec(fd)
+	return
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
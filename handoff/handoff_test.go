@@ -0,0 +1,134 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handoff_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/tsavola/lazymem/handoff"
+)
+
+func socketPair(t *testing.T) (a, b *net.UnixConn) {
+	t.Helper()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socket")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+
+	return conns[0], conns[1]
+}
+
+func TestSendReceive(t *testing.T) {
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	f, err := os.Open("/dev/zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sent := handoff.Header{
+		Size:  12345,
+		Kind:  handoff.Shared,
+		Flags: syscall.MAP_SHARED,
+		Label: "test label",
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := handoff.Send(a, int(f.Fd()), sent); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		fd, received, err := handoff.Receive(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(fd)
+
+		if received != sent {
+			t.Errorf("%#v", received)
+		}
+	}
+}
+
+func TestReceiveExact(t *testing.T) {
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	f, err := os.Open("/dev/zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sent := handoff.Header{
+		Size:  4096,
+		Kind:  handoff.Temporal,
+		Flags: syscall.MAP_PRIVATE,
+		Label: "label",
+	}
+
+	if err := handoff.Send(a, int(f.Fd()), sent); err != nil {
+		t.Fatal(err)
+	}
+
+	trailer := []byte("data which follows the message")
+	if _, err := a.Write(trailer); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, received, err := handoff.Receive(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+
+	if received != sent {
+		t.Errorf("%#v", received)
+	}
+
+	result := make([]byte, len(trailer))
+	if _, err := io.ReadFull(b, result); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, trailer) {
+		t.Errorf("trailer: %q", result)
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	for _, h := range []handoff.Header{
+		{Size: 0, Kind: handoff.Shared, Flags: syscall.MAP_SHARED},
+		{Size: 4096, Kind: 0, Flags: syscall.MAP_PRIVATE},
+		{Size: 4096, Kind: handoff.Temporal, Flags: syscall.MAP_SHARED},
+		{Size: 4096, Kind: handoff.Cloned, Flags: syscall.MAP_SHARED | syscall.MAP_PRIVATE},
+	} {
+		if err := h.Validate(); err == nil {
+			t.Errorf("invalid header accepted: %#v", h)
+		}
+	}
+}
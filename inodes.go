@@ -0,0 +1,61 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type node struct {
+	buffer
+	handles int32 // atomic
+	charged int32 // atomic; nonzero while counted against quotas
+
+	forgotten int32 // atomic; nonzero after the kernel has forgotten the inode
+
+	invalidating int32 // atomic; nonzero while InvalidateCache opens the file
+}
+
+// inodeTable allows concurrent lookups under a single lock.  Whether sharding
+// would help can be measured with BenchmarkMultiProcessFault on a multi-core
+// machine.
+type inodeTable struct {
+	lock   sync.RWMutex
+	nodes  map[fuseops.InodeID]*node
+	lastId fuseops.InodeID
+}
+
+func (t *inodeTable) init(lastId fuseops.InodeID) {
+	t.nodes = make(map[fuseops.InodeID]*node)
+	t.lastId = lastId
+}
+
+func (t *inodeTable) insert(b buffer) (id fuseops.InodeID) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.lastId++
+	id = t.lastId
+	t.nodes[id] = &node{buffer: b, charged: 1}
+	return
+}
+
+func (t *inodeTable) lookup(id fuseops.InodeID) (n *node) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.nodes[id]
+}
+
+func (t *inodeTable) remove(id fuseops.InodeID) (n *node) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n = t.nodes[id]
+	delete(t.nodes, id)
+	return
+}
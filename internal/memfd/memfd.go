@@ -0,0 +1,66 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package memfd wraps the memfd_create system call and file sealing, which
+// are not exposed by the syscall package.
+package memfd
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Flags for Create.
+const (
+	CLOEXEC       = 0x1
+	ALLOW_SEALING = 0x2
+)
+
+// Seals for AddSeals.
+const (
+	SEAL_SEAL   = 0x1
+	SEAL_SHRINK = 0x2
+	SEAL_GROW   = 0x4
+	SEAL_WRITE  = 0x8
+)
+
+const (
+	fcntlAddSeals = 1033
+	fcntlGetSeals = 1034
+)
+
+// Create an anonymous memory file.
+func Create(name string, flags int) (fd int, err error) {
+	nameBuf := append([]byte(name), 0)
+
+	r, _, errno := syscall.Syscall(sysMemfdCreate, uintptr(unsafe.Pointer(&nameBuf[0])), uintptr(flags), 0)
+	if errno != 0 {
+		err = errno
+		return
+	}
+
+	fd = int(r)
+	return
+}
+
+// AddSeals to a memory file created with ALLOW_SEALING.
+func AddSeals(fd, seals int) (err error) {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), fcntlAddSeals, uintptr(seals))
+	if errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// Seals which have been added to a memory file.
+func Seals(fd int) (seals int, err error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), fcntlGetSeals, 0)
+	if errno != 0 {
+		err = errno
+		return
+	}
+
+	seals = int(r)
+	return
+}
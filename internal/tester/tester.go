@@ -5,32 +5,42 @@
 package tester
 
 import (
-	"bytes"
 	"fmt"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/tsavola/lazymem/consumer"
+	"github.com/tsavola/lazymem/handoff"
 )
 
 const BenchmarkSize = 128 * 1024 * 1024
 
 var Tests = map[string]func([]string){
 	"TestDelay": func(args []string) {
-		mem, err := syscall.Mmap(0, 0, 256*4096, syscall.PROT_READ, syscall.MAP_PRIVATE)
+		m, err := consumer.Map(0, handoff.Header{
+			Size:  256 * 4096,
+			Kind:  handoff.Temporal,
+			Flags: syscall.MAP_PRIVATE,
+		}, syscall.PROT_READ, syscall.MAP_PRIVATE)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer func() {
-			if err := syscall.Munmap(mem); err != nil {
+			if err := m.Unmap(); err != nil {
 				log.Print(err)
 			}
 		}()
 
+		mem := m.Bytes()
+
 		for i := 0; i < 256; i++ {
 			offset := i * 4096
 			value := mem[offset]
@@ -50,16 +60,22 @@ var Tests = map[string]func([]string){
 			log.Fatal(err)
 		}
 
-		mem, err := syscall.Mmap(0, 0, 256*4096, syscall.PROT_READ|syscall.PROT_WRITE, flags)
+		m, err := consumer.Map(0, handoff.Header{
+			Size:  256 * 4096,
+			Kind:  handoff.Shared,
+			Flags: handoff.KindFlags(handoff.Shared),
+		}, syscall.PROT_READ|syscall.PROT_WRITE, flags)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer func() {
-			if err := syscall.Munmap(mem); err != nil {
+			if err := m.Unmap(); err != nil {
 				log.Print(err)
 			}
 		}()
 
+		mem := m.Bytes()
+
 		for i := 0; i < 256*4096; i++ {
 			mem[i]++
 		}
@@ -71,13 +87,22 @@ var Tests = map[string]func([]string){
 			log.Fatal(err)
 		}
 
-		mem, err := syscall.Mmap(0, 0, length, syscall.PROT_READ, syscall.MAP_PRIVATE)
+		m, err := consumer.Map(0, handoff.Header{
+			Size:  int64(length),
+			Kind:  handoff.Temporal,
+			Flags: syscall.MAP_PRIVATE,
+		}, syscall.PROT_READ, syscall.MAP_PRIVATE)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer syscall.Munmap(mem)
+		defer m.Unmap()
 
-		image, err := jpeg.Decode(bytes.NewReader(mem))
+		if err := m.Sequential(); err != nil {
+			log.Fatal(err)
+		}
+
+		// a failed download is reported as a decoding error instead of SIGBUS
+		image, err := jpeg.Decode(io.NewSectionReader(m, 0, int64(m.Len())))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -107,6 +132,47 @@ var Tests = map[string]func([]string){
 		}
 	},
 
+	"BenchmarkParallelFault": func(args []string) {
+		threads, err := strconv.Atoi(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		size := BenchmarkSize
+		if len(args) > 1 {
+			size, err = strconv.Atoi(args[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		mem, err := syscall.Mmap(0, 0, size, syscall.PROT_READ, syscall.MAP_PRIVATE)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// no explicit munmap
+
+		runtime.GOMAXPROCS(threads)
+
+		var wg sync.WaitGroup
+
+		for t := 0; t < threads; t++ {
+			wg.Add(1)
+			go func(t int) {
+				defer wg.Done()
+
+				// interleave 128 kB blocks between threads
+				for i := t * 131072; i < size; i += threads * 131072 {
+					for j := i; j < i+131072; j += 4096 {
+						runtime.KeepAlive(mem[j])
+					}
+				}
+			}(t)
+		}
+
+		wg.Wait()
+	},
+
 	"BenchmarkSharedWrite": func(args []string) {
 		mem, err := syscall.Mmap(0, 0, BenchmarkSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 		if err != nil {
@@ -0,0 +1,79 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wrap builds buffer wrappers which implement the same optional
+// interfaces as the buffers they wrap.
+package wrap
+
+import (
+	"context"
+	"io"
+
+	"github.com/tsavola/lazymem"
+)
+
+// Reader of a wrapper.  ReadAtContext should pass the context to the wrapped
+// buffer via ReadAtContext, so that the filesystem can interrupt reads which
+// wait for content.
+type Reader interface {
+	io.ReaderAt
+	ReadAtContext(ctx context.Context, b []byte, offset int64) (int, error)
+}
+
+// ReadAtContext calls r.ReadAtContext if r implements it, or r.ReadAt.
+func ReadAtContext(ctx context.Context, r io.ReaderAt, b []byte, offset int64) (int, error) {
+	if c, ok := r.(interface {
+		ReadAtContext(context.Context, []byte, int64) (int, error)
+	}); ok {
+		return c.ReadAtContext(ctx, b, offset)
+	}
+	return r.ReadAt(b, offset)
+}
+
+// populator has the method of lazymem.PopulatedBuffer.  (An embedded field
+// named Populated would hide the method.)
+type populator interface {
+	Populated() <-chan struct{}
+}
+
+type base struct {
+	Reader
+	io.WriterAt
+	io.Closer
+}
+
+// Buffer combines the wrapper's reader, writer and closer with the optional
+// interfaces implemented by the wrapped buffer, which are forwarded to
+// inner.  Nil writer or closer may be passed if the result is used as a
+// buffer kind which doesn't need them.
+func Buffer(inner interface{}, r Reader, w io.WriterAt, c io.Closer) interface{} {
+	b := base{r, w, c}
+
+	p, _ := inner.(populator)
+	l, _ := inner.(lazymem.LifecycleBuffer)
+
+	switch {
+	case p != nil && l != nil:
+		return struct {
+			base
+			populator
+			lazymem.LifecycleBuffer
+		}{b, p, l}
+
+	case p != nil:
+		return struct {
+			base
+			populator
+		}{b, p}
+
+	case l != nil:
+		return struct {
+			base
+			lazymem.LifecycleBuffer
+		}{b, l}
+
+	default:
+		return b
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+// InvalidateCache drops the kernel's cached pages of a shared buffer after
+// the host has modified its content, so that existing MAP_SHARED mappings and
+// subsequent reads fetch the new content from the buffer.  Pages dirtied by
+// the consumer are written back to the buffer before they are dropped;
+// overlapping modifications are not merged.
+//
+// The FUSE binding doesn't support inode invalidation notifications, which
+// could target a range.  Instead, the buffer is opened without keeping the
+// page cache, which drops the whole file's pages.
+func (m *Manager) InvalidateCache(fd int) (err error) {
+	s, id, b, err := m.lookupFd(fd)
+	if err != nil {
+		return
+	}
+
+	if b.kind != kindShared {
+		err = syscall.EINVAL
+		return
+	}
+
+	n := s.fs.nodes.lookup(id)
+	if n == nil {
+		err = syscall.EBADF
+		return
+	}
+
+	atomic.AddInt32(&n.invalidating, 1)
+	defer atomic.AddInt32(&n.invalidating, -1)
+
+	hostFd, err := m.openNode(s, id, syscall.O_RDONLY)
+	if err != nil {
+		return
+	}
+
+	err = syscall.Close(hostFd)
+	return
+}
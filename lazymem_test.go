@@ -5,18 +5,33 @@
 package lazymem_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/chaos"
+	"github.com/tsavola/lazymem/composite"
+	"github.com/tsavola/lazymem/internal/memfd"
 	_ "github.com/tsavola/lazymem/internal/tester" // cache workaround
 	"github.com/tsavola/lazymem/linear"
+	"github.com/tsavola/lazymem/overlay"
+	"github.com/tsavola/lazymem/profile"
 	"github.com/tsavola/lazymem/sparse"
 )
 
@@ -38,32 +53,42 @@ type tOrB interface {
 func runTester(t tOrB, testName string, fd int, args ...string) {
 	t.Helper()
 
-	args = append([]string{goBin, "run", "internal/runtester.go", testName}, args...)
+	execTester(t, goBin, append([]string{goBin, "run", "internal/runtester.go", testName}, args...), fd)
+}
+
+func execTester(t tOrB, filename string, args []string, fd int) {
+	t.Helper()
+
+	if err := spawnTester(filename, args, fd); err != nil {
+		t.Fatal(err)
+	}
+}
 
-	pid, err := syscall.ForkExec(goBin, args, &syscall.ProcAttr{
+// spawnTester doesn't fail the test, so it can be called from any goroutine.
+func spawnTester(filename string, args []string, fd int) (err error) {
+	pid, err := syscall.ForkExec(filename, args, &syscall.ProcAttr{
 		Env:   syscall.Environ(),
 		Files: []uintptr{uintptr(fd), 1, 2},
 	})
 	if err != nil {
-		t.Fatal(err)
+		return
 	}
 
 	var status syscall.WaitStatus
 
 	_, err = syscall.Wait4(pid, &status, 0, nil)
 	if err != nil {
-		t.Fatal(err)
+		return
 	}
 
 	if status.Exited() {
 		if code := status.ExitStatus(); code != 0 {
-			t.Fatal("tester error code:", code)
+			err = fmt.Errorf("tester error code: %d", code)
 		}
 	} else {
-		t.Fatal("tester status:", status)
+		err = fmt.Errorf("tester status: %v", status)
 	}
 	return
-
 }
 
 type testLogger struct{ tOrB }
@@ -84,6 +109,204 @@ func newConfig(t tOrB, debug bool) (config *lazymem.Config) {
 	return
 }
 
+func TestConfigValidation(t *testing.T) {
+	for _, config := range []*lazymem.Config{
+		{MaxRead: 1000},
+		{MaxRead: 1048576},
+		{MaxReadahead: -4096},
+		{MountOptions: map[string]string{"ro": ""}},
+	} {
+		if _, err := lazymem.New(context.Background(), config); !errors.Is(err, lazymem.ErrInvalidConfig) {
+			t.Errorf("invalid config: %#v: %v", config, err)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	ctx := context.Background()
+
+	if err := lazymem.Preflight(ctx, newConfig(t, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lazymem.Preflight(ctx, &lazymem.Config{MaxRead: 1}); !errors.Is(err, lazymem.ErrInvalidConfig) {
+		t.Errorf("invalid config: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(dir, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := newConfig(t, false)
+	config.Mountpoint = dir
+
+	if err := lazymem.Preflight(ctx, config); !errors.Is(err, lazymem.ErrMountpointBusy) {
+		t.Errorf("non-empty mountpoint: %v", err)
+	}
+
+	// Preflight is stricter than the mount helper.
+	if mm, err := lazymem.New(ctx, config); err != nil {
+		t.Errorf("non-empty mountpoint: %v", err)
+	} else if err := mm.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+
+	mm, err := lazymem.New(ctx, newConfig(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mm.Shutdown(ctx)
+
+	config = newConfig(t, false)
+	config.Mountpoint = mm.Mountpoint
+
+	err = lazymem.Preflight(ctx, config)
+	if !errors.Is(err, lazymem.ErrMountpointBusy) {
+		t.Errorf("mounted mountpoint: %v", err)
+	}
+
+	var pe *lazymem.PreflightError
+	if !errors.As(err, &pe) || pe.Hint == "" {
+		t.Errorf("no hint: %v", err)
+	}
+}
+
+func TestMountDiagnosis(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	_, err := lazymem.New(context.Background(), newConfig(t, false))
+	if !errors.Is(err, lazymem.ErrMountFailed) || !errors.Is(err, lazymem.ErrFusermountUnavailable) {
+		t.Fatalf("mount without fusermount: %v", err)
+	}
+	if !strings.Contains(err.Error(), "running fusermount") {
+		t.Errorf("mount error is missing: %v", err)
+	}
+}
+
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+func TestLogHandler(t *testing.T) {
+	ctx := context.Background()
+
+	var output syncBuffer
+
+	mm, err := lazymem.New(ctx, &lazymem.Config{
+		LogHandler:     slog.NewTextHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		StallThreshold: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := sparse.NewBuffer()
+
+	fd, err := mm.CreateTemporal(4096, syscall.O_RDONLY, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		buf.ProduceFrame(make([]byte, 4096), 0)
+		buf.ProductionFinished()
+	}()
+
+	if _, err := syscall.Pread(fd, make([]byte, 4096), 0); err != nil {
+		t.Error(err)
+	}
+
+	syscall.Close(fd)
+
+	if err := mm.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s := output.String()
+	t.Log(s)
+
+	for _, msg := range []string{"mounted", "buffer created", "buffer opened", "read stalled", "buffer released", "unmounted"} {
+		if !strings.Contains(s, "msg="+msg+" ") && !strings.Contains(s, "msg=\""+msg+"\"") {
+			t.Errorf("%q not logged", msg)
+		}
+	}
+
+	if !strings.Contains(s, "kind=temporal") {
+		t.Error("kind not logged")
+	}
+}
+
+// TestLogLegacy checks that read problems don't go to ErrorLog, and that
+// end of content isn't logged as an error.
+func TestLogLegacy(t *testing.T) {
+	ctx := context.Background()
+
+	var errorOutput, debugOutput syncBuffer
+
+	mm, err := lazymem.New(ctx, &lazymem.Config{
+		ErrorLog:       log.New(&errorOutput, "", 0),
+		DebugLog:       log.New(&debugOutput, "", 0),
+		StallThreshold: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stalled := sparse.NewBuffer()
+	empty := sparse.NewBuffer()
+	empty.ProductionFinished()
+
+	for _, buf := range []*sparse.Buffer{stalled, empty} {
+		fd, err := mm.CreateTemporal(4096, syscall.O_RDONLY, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if buf == stalled {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				buf.ProduceFrame(make([]byte, 4096), 0)
+				buf.ProductionFinished()
+			}()
+		}
+
+		syscall.Pread(fd, make([]byte, 4096), 0)
+		syscall.Close(fd)
+	}
+
+	if err := mm.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The FUSE binding logs failed ops to ErrorLog by itself.
+	if s := errorOutput.String(); strings.Contains(s, "read stalled") || strings.Contains(s, "read error") {
+		t.Errorf("error log: %s", s)
+	}
+
+	s := debugOutput.String()
+	if !strings.Contains(s, "read stalled") {
+		t.Error("stall not logged")
+	}
+	if strings.Contains(s, "read error") {
+		t.Error("end of content logged as read error")
+	}
+}
+
 func TestDelay(t *testing.T) {
 	ctx := context.Background()
 
@@ -124,12 +347,7 @@ func TestDelay(t *testing.T) {
 	runTester(t, t.Name(), fd)
 }
 
-func TestWritePrivate(t *testing.T) { testWrite(t, syscall.MAP_PRIVATE) }
-func TestWriteShared(t *testing.T)  { testWrite(t, syscall.MAP_SHARED) }
-
-func testWrite(t *testing.T, flags int) {
-	t.Helper()
-
+func TestLifecycle(t *testing.T) {
 	ctx := context.Background()
 
 	mm, err := lazymem.New(ctx, newConfig(t, testing.Verbose()))
@@ -142,39 +360,921 @@ func testWrite(t *testing.T, flags int) {
 		}
 	}()
 
-	buf := linear.NewBuffer(make([]byte, 256*4096))
+	buf := sparse.NewBuffer()
+	life := lazymem.NewLifecycle(ctx)
+
+	fd, err := mm.CreateTemporal(4096, syscall.O_RDONLY, struct {
+		*sparse.Buffer
+		*lazymem.Lifecycle
+	}{buf, life})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-life.Opened():
+	default:
+		t.Error("buffer not opened")
+	}
+
+	select {
+	case <-life.Context().Done():
+		t.Error("context canceled while open")
+	default:
+	}
+
+	if err := syscall.Close(fd); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-life.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Error("context not canceled after release")
+	}
+}
+
+func TestLifecycleCreateFailure(t *testing.T) {
+	ctx := context.Background()
+
+	config := newConfig(t, testing.Verbose())
+	config.MaxPages = 1
+
+	mm, err := lazymem.New(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer func() {
-		<-buf.Closed()
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
 	}()
 
-	fd, err := mm.Create(int64(buf.Len()), syscall.O_RDWR, buf)
+	life := lazymem.NewLifecycle(ctx)
+
+	if _, err := mm.CreateTemporal(2*4096, syscall.O_RDONLY, struct {
+		*sparse.Buffer
+		*lazymem.Lifecycle
+	}{sparse.NewBuffer(), life}); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-life.Forgotten():
+	default:
+		t.Error("not forgotten")
+	}
+
+	select {
+	case <-life.Opened():
+		t.Error("opened")
+	default:
+	}
+
+	if life.Context().Err() == nil {
+		t.Error("context not canceled")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+
+	config := newConfig(t, testing.Verbose())
+	config.MaxPages = 4
+	config.MaxBuffers = 2
+
+	mm, err := lazymem.New(ctx, config)
 	if err != nil {
-		buf.Close()
 		t.Fatal(err)
 	}
 	defer func() {
-		if err := syscall.Close(fd); err != nil {
+		if err := mm.Shutdown(ctx); err != nil {
 			t.Error(err)
 		}
 	}()
 
+	create := func(size int64) (int, error) {
+		return mm.CreateTemporal(size, syscall.O_RDONLY, sparse.NewBuffer())
+	}
+
+	fd1, err := create(3 * 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(fd1, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks != 4 || st.Bfree != 1 || st.Files != 3 || st.Ffree != 1 {
+		t.Errorf("statfs: %+v", st)
+	}
+
+	_, err = create(2 * 4096)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("pages: %v", err)
+	}
+
+	fd2, err := create(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = create(0)
+	var qe *lazymem.QuotaError
+	if !errors.As(err, &qe) || qe.Resource != "buffers" {
+		t.Errorf("buffers: %v", err)
+	}
+
+	syscall.Close(fd1)
+	syscall.Close(fd2)
+
+	// The kernel forgets released inodes asynchronously.
+	for i := 0; ; i++ {
+		fd, err := create(4 * 4096)
+		if err == nil {
+			syscall.Close(fd)
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	mm, err := lazymem.New(context.Background(), newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := mm.CreateTemporal(4096, syscall.O_RDONLY, sparse.NewBuffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if outcome, err := mm.Drain(ctx); outcome != lazymem.ShutdownFailed || err == nil {
+		t.Errorf("%v: %v", outcome, err)
+	}
+
+	// Buffers can be created after a failed drain.
+	fd2, err := mm.CreateTemporal(4096, syscall.O_RDONLY, sparse.NewBuffer())
+	if err != nil {
+		t.Errorf("create: %v", err)
+	}
+
 	go func() {
-		defer buf.PopulationFinished()
-		b := buf.Bytes()
+		time.Sleep(10 * time.Millisecond)
+		syscall.Close(fd)
+		syscall.Close(fd2)
+	}()
 
-		for i := 0; i < buf.Len()/linear.BlockSize; i++ {
-			time.Sleep(100 * time.Millisecond)
+	if outcome, err := mm.Drain(context.Background()); outcome != lazymem.ShutdownClean || err != nil {
+		t.Errorf("%v: %v", outcome, err)
+	}
+}
 
-			for j := 0; j < linear.BlockSize; j++ {
-				b[j] = byte(i + j)
-			}
+func TestShutdownBusy(t *testing.T) {
+	mm, err := lazymem.New(context.Background(), newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			b = b[linear.BlockSize:]
-			buf.BlockPopulated(i)
+	fd, err := mm.CreateTemporal(4096, syscall.O_RDONLY, sparse.NewBuffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := mm.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown while buffer is in use: %v", err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- mm.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown didn't wait for buffer release: %v", err)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	syscall.Close(fd)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked after buffer release")
+	}
+}
+
+// TestDetachPendingRead checks that a read which waits for content is failed
+// when the filesystem is detached, also through wrappers.
+func TestDetachPendingRead(t *testing.T) {
+	temporal := func(wrap func(lazymem.TemporalBuffer) lazymem.TemporalBuffer) func(*lazymem.Manager) (int, error) {
+		return func(mm *lazymem.Manager) (int, error) {
+			return mm.CreateTemporal(4096, syscall.O_RDONLY, wrap(sparse.NewBuffer()))
 		}
+	}
+
+	for name, create := range map[string]func(*lazymem.Manager) (int, error){
+		"Sparse": temporal(func(b lazymem.TemporalBuffer) lazymem.TemporalBuffer { return b }),
+		"Chaos": temporal(func(b lazymem.TemporalBuffer) lazymem.TemporalBuffer {
+			return chaos.Temporal(b, nil)
+		}),
+		"Profile": temporal(func(b lazymem.TemporalBuffer) lazymem.TemporalBuffer {
+			return profile.NewRecorder(0).Temporal(b)
+		}),
+		"Composite": temporal(func(b lazymem.TemporalBuffer) lazymem.TemporalBuffer {
+			c, err := composite.New(4096, composite.Part{Length: 4096, Source: b})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}),
+		"Overlay": func(mm *lazymem.Manager) (int, error) {
+			return mm.Create(4096, syscall.O_RDWR, overlay.New(linear.NewBuffer(make([]byte, 4096)), 4096))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testDetachPendingRead(t, create)
+		})
+	}
+}
+
+func testDetachPendingRead(t *testing.T, create func(*lazymem.Manager) (int, error)) {
+	config := newConfig(t, testing.Verbose())
+	config.DetachOnShutdown = true
+
+	mm, err := lazymem.New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := create(mm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := syscall.Pread(fd, make([]byte, 4096), 0)
+		done <- err
 	}()
 
-	runTester(t, "TestWrite", fd, strconv.Itoa(flags))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if outcome, err := mm.Drain(ctx); outcome != lazymem.ShutdownDetached || err != nil {
+		t.Errorf("%v: %v", outcome, err)
+	}
+
+	select {
+	case err := <-done:
+		if err != syscall.EIO {
+			t.Errorf("read: %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Error("read still blocked after detach")
+	}
+}
+
+func TestDrainDetach(t *testing.T)      { testDrainDetach(t, false, lazymem.ShutdownDetached) }
+func TestDrainDetachAbort(t *testing.T) { testDrainDetach(t, true, lazymem.ShutdownForced) }
+
+func testDrainDetach(t *testing.T, abort bool, expect lazymem.ShutdownOutcome) {
+	if abort {
+		if _, err := os.Stat("/sys/fs/fuse/connections"); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	config := newConfig(t, testing.Verbose())
+	config.DetachOnShutdown = true
+	config.AbortOnShutdown = abort
+
+	mm, err := lazymem.New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := sparse.NewBuffer()
+	buf.ProduceFrame(make([]byte, 4096), 0)
+	buf.ProductionFinished()
+
+	fd, err := mm.CreateTemporal(4096, syscall.O_RDONLY, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	outcome, err := mm.Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != expect {
+		t.Errorf("outcome: %v", outcome)
+	}
+
+	if _, err := syscall.Pread(fd, make([]byte, 4096), 0); err == nil {
+		t.Error("read succeeded after detach")
+	}
+
+	if _, err := os.Stat(mm.Mountpoint); !os.IsNotExist(err) {
+		t.Errorf("mountpoint: %v", err)
+	}
+}
+
+func TestUnmountDetection(t *testing.T) {
+	ctx := context.Background()
+
+	config := newConfig(t, testing.Verbose())
+	config.Remount = true
+
+	// Remounting must not depend on the context passed to New.
+	newCtx, cancel := context.WithCancel(ctx)
+
+	mm, err := lazymem.New(newCtx, config)
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := mm.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	done := mm.Done()
+
+	if err := syscall.Unmount(mm.Mountpoint, 0); err != nil {
+		t.Skip(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("unmount not detected")
+	}
+
+	if err := mm.Err(); err != lazymem.ErrUnmounted {
+		t.Errorf("err: %v", err)
+	}
+	if err := mm.Ping(ctx); err != lazymem.ErrUnmounted {
+		t.Errorf("ping: %v", err)
+	}
+
+	buf := sparse.NewBuffer()
+	buf.ProduceFrame(make([]byte, 4096), 0)
+	buf.ProductionFinished()
+
+	fd, err := mm.CreateTemporal(4096, syscall.O_RDONLY, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syscall.Pread(fd, make([]byte, 4096), 0); err != nil {
+		t.Errorf("read after remount: %v", err)
+	}
+	syscall.Close(fd)
+
+	if err := mm.Err(); err != nil {
+		t.Errorf("err after remount: %v", err)
+	}
+	if err := mm.Ping(ctx); err != nil {
+		t.Errorf("ping after remount: %v", err)
+	}
+}
+
+func TestDrainUnmounted(t *testing.T) {
+	mm, err := lazymem.New(context.Background(), newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := mm.Done()
+
+	if err := syscall.Unmount(mm.Mountpoint, 0); err != nil {
+		t.Skip(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("unmount not detected")
+	}
+
+	if outcome, err := mm.Drain(context.Background()); outcome != lazymem.ShutdownUnmounted || err != nil {
+		t.Errorf("%v: %v", outcome, err)
+	}
+}
+
+func TestPromoteCloned(t *testing.T) {
+	ctx := context.Background()
+
+	config := newConfig(t, testing.Verbose())
+	config.PromoteCloned = true
+
+	mm, err := lazymem.New(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf := linear.NewBuffer(make([]byte, 256*4096))
+
+	fd, err := mm.CreateCloned(int64(buf.Len()), syscall.O_RDONLY, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := syscall.Close(fd); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	b := buf.Bytes()
+	for i := 0; i < 256; i++ {
+		b[i*4096] = byte(i)
+	}
+	buf.BlocksPopulated(0, buf.Len()/linear.BlockSize)
+	buf.PopulationFinished()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		newFd, err := mm.Reopen(fd, syscall.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := memfd.Seals(newFd); err == nil {
+			runTester(t, "TestDelay", newFd)
+			syscall.Close(newFd)
+			break
+		}
+
+		syscall.Close(newFd)
+
+		if time.Now().After(deadline) {
+			t.Fatal("buffer was not promoted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	runTester(t, "TestDelay", fd)
+}
+
+type countingBuffer struct {
+	*linear.Buffer
+	reads     int32
+	populated int32
+}
+
+func (b *countingBuffer) ReadAt(target []byte, sourceOffset int64) (int, error) {
+	atomic.AddInt32(&b.reads, 1)
+	return b.Buffer.ReadAt(target, sourceOffset)
+}
+
+func (b *countingBuffer) Populated() <-chan struct{} {
+	atomic.AddInt32(&b.populated, 1)
+	return b.Buffer.Populated()
+}
+
+func TestPromoteClonedFailure(t *testing.T) {
+	ctx := context.Background()
+
+	config := newConfig(t, testing.Verbose())
+	config.PromoteCloned = true
+	config.MaxPages = 1
+
+	mm, err := lazymem.New(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf := &countingBuffer{Buffer: linear.NewBuffer(make([]byte, linear.BlockSize))}
+	buf.BlocksPopulated(0, 1)
+	buf.PopulationFinished()
+
+	if _, err := mm.CreateCloned(int64(buf.Len()), syscall.O_RDONLY, buf); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal(err)
+	}
+
+	// Promotion would have to wait for the buffer to be populated before
+	// reading it.
+	if atomic.LoadInt32(&buf.populated) != 0 {
+		t.Error("promotion of rejected buffer was started")
+	}
+	if n := atomic.LoadInt32(&buf.reads); n != 0 {
+		t.Errorf("rejected buffer was read %d times", n)
+	}
+}
+
+func TestWritePrivate(t *testing.T)      { testWrite(t, syscall.MAP_PRIVATE, newHeapBuffer) }
+func TestWriteShared(t *testing.T)       { testWrite(t, syscall.MAP_SHARED, newHeapBuffer) }
+func TestWriteSharedMapped(t *testing.T) { testWrite(t, syscall.MAP_SHARED, linear.NewMappedBuffer) }
+func TestWriteSharedMemfd(t *testing.T)  { testWrite(t, syscall.MAP_SHARED, newMemfdBuffer) }
+
+func newHeapBuffer(size int) (*linear.Buffer, error) {
+	return linear.NewBuffer(make([]byte, size)), nil
+}
+
+func newMemfdBuffer(size int) (*linear.Buffer, error) {
+	return linear.NewMemfdBuffer("lazymem-test", size)
+}
+
+func testWrite(t *testing.T, flags int, newBuffer func(int) (*linear.Buffer, error)) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	mm, err := lazymem.New(ctx, newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf, err := newBuffer(256 * 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		<-buf.Closed()
+		if err := buf.Free(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	fd, err := mm.Create(int64(buf.Len()), syscall.O_RDWR, buf)
+	if err != nil {
+		buf.Close()
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := syscall.Close(fd); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	go func() {
+		defer buf.PopulationFinished()
+		b := buf.Bytes()
+
+		for i := 0; i < buf.Len()/linear.BlockSize; i++ {
+			time.Sleep(100 * time.Millisecond)
+
+			for j := 0; j < linear.BlockSize; j++ {
+				b[j] = byte(i + j)
+			}
+
+			b = b[linear.BlockSize:]
+			buf.BlockPopulated(i)
+		}
+	}()
+
+	runTester(t, "TestWrite", fd, strconv.Itoa(flags))
+}
+
+func TestInvalidateCache(t *testing.T) {
+	ctx := context.Background()
+
+	mm, err := lazymem.New(ctx, newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	const size = 2 * linear.BlockSize
+
+	buf := linear.NewBuffer(make([]byte, size))
+	buf.BlocksPopulated(0, 2)
+	buf.PopulationFinished()
+
+	fd, err := mm.Create(size, syscall.O_RDWR, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	result := make([]byte, size)
+	if _, err := syscall.Pread(fd, result, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	mem, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Munmap(mem)
+
+	consumerData := []byte("modified by the consumer")
+	copy(mem[size-100:], consumerData)
+
+	data := []byte("modified by the host")
+	copy(buf.Bytes()[linear.BlockSize-5:], data)
+
+	if err := mm.InvalidateCache(fd); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := syscall.Pread(fd, result, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, buf.Bytes()) {
+		t.Error("stale content")
+	}
+	if !bytes.Equal(mem, buf.Bytes()) {
+		t.Error("stale mapping")
+	}
+	if !bytes.Equal(buf.Bytes()[size-100:size-100+len(consumerData)], consumerData) {
+		t.Error("consumer modification was lost")
+	}
+
+	clonedBuf := linear.NewBuffer(make([]byte, size))
+	clonedBuf.PopulationFinished()
+
+	cloned, err := mm.CreateCloned(size, syscall.O_RDONLY, clonedBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(cloned)
+
+	if err := mm.InvalidateCache(cloned); err != syscall.EINVAL {
+		t.Errorf("cloned: %v", err)
+	}
+}
+
+// notifyingBuffer signals writes, so that the test can check the content
+// without racing with the filesystem.
+type notifyingBuffer struct {
+	*linear.Buffer
+	written chan struct{}
+}
+
+func (b *notifyingBuffer) WriteAt(source []byte, targetOffset int64) (int, error) {
+	n, err := b.Buffer.WriteAt(source, targetOffset)
+	select {
+	case b.written <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+func TestView(t *testing.T) {
+	ctx := context.Background()
+
+	mm, err := lazymem.New(ctx, newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	const (
+		size   = 3 * linear.BlockSize
+		offset = linear.BlockSize + 100
+		length = linear.BlockSize
+	)
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	buf := &notifyingBuffer{linear.NewBuffer(data), make(chan struct{}, 1)}
+	buf.BlocksPopulated(0, 3)
+	buf.PopulationFinished()
+
+	fd, err := mm.Create(size, syscall.O_RDWR, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mm.CreateView(fd, offset, size, syscall.O_RDONLY); err != syscall.EINVAL {
+		t.Errorf("out of bounds: %v", err)
+	}
+
+	view, err := mm.CreateView(fd, offset, length, syscall.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The view keeps the buffer open.
+	syscall.Close(fd)
+
+	result := make([]byte, length+100)
+	n, err := syscall.Pread(view, result, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != length || !bytes.Equal(result[:n], data[offset:offset+length]) {
+		t.Errorf("content mismatch (%d bytes)", n)
+	}
+
+	patch := []byte("written via a view")
+	if _, err := syscall.Pwrite(view, patch, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Fsync(view); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-buf.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write not translated")
+	}
+
+	if !bytes.Equal(data[offset+10:offset+10+len(patch)], patch) {
+		t.Error("write not translated")
+	}
+
+	select {
+	case <-buf.Closed():
+		t.Error("buffer closed while viewed")
+	default:
+	}
+
+	syscall.Close(view)
+
+	select {
+	case <-buf.Closed():
+	case <-time.After(5 * time.Second):
+		t.Error("buffer not closed after view")
+	}
+
+	temporal, err := mm.CreateTemporal(4096, syscall.O_RDONLY, sparse.NewBuffer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(temporal)
+
+	if _, err := mm.CreateView(temporal, 0, 4096, syscall.O_RDONLY); err != syscall.EINVAL {
+		t.Errorf("temporal: %v", err)
+	}
+}
+
+// TestViewForget checks that a buffer isn't forgotten while a view holds it,
+// even if the kernel forgets its inode.
+func TestViewForget(t *testing.T) {
+	ctx := context.Background()
+
+	mm, err := lazymem.New(ctx, newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	buf := linear.NewBuffer(make([]byte, linear.BlockSize))
+	buf.BlocksPopulated(0, 1)
+	buf.PopulationFinished()
+
+	life := lazymem.NewLifecycle(ctx)
+
+	fd, err := mm.CreateCloned(linear.BlockSize, syscall.O_RDONLY, struct {
+		*linear.Buffer
+		*lazymem.Lifecycle
+	}{buf, life})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := mm.CreateView(fd, 0, 4096, syscall.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syscall.Close(fd)
+
+	// Evict the buffer's inode from the kernel's cache.
+	if err := ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0); err != nil {
+		syscall.Close(view)
+		t.Skip(err)
+	}
+
+	select {
+	case <-life.Forgotten():
+		t.Error("forgotten while viewed")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if life.Context().Err() != nil {
+		t.Error("context canceled while viewed")
+	}
+
+	if _, err := syscall.Pread(view, make([]byte, 4096), 0); err != nil {
+		t.Error(err)
+	}
+
+	syscall.Close(view)
+
+	select {
+	case <-life.Forgotten():
+	case <-time.After(5 * time.Second):
+		t.Error("not forgotten after view")
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	ctx := context.Background()
+
+	mm, err := lazymem.New(ctx, newConfig(t, testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mm.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	const size = linear.BlockSize
+
+	base := linear.NewBuffer(bytes.Repeat([]byte{7}, size))
+	base.BlocksPopulated(0, 1)
+	base.PopulationFinished()
+
+	a := overlay.New(base, size)
+	b := overlay.New(base, size)
+
+	fdA, err := mm.Create(size, syscall.O_RDWR, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fdA)
+
+	fdB, err := mm.Create(size, syscall.O_RDWR, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fdB)
+
+	if _, err := syscall.Pwrite(fdA, []byte("guest a"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Fsync(fdA); err != nil {
+		t.Fatal(err)
+	}
+
+	if blocks := a.ModifiedBlocks(); len(blocks) != 1 || blocks[0] != 5000/overlay.BlockSize {
+		t.Errorf("modified blocks: %v", blocks)
+	}
+
+	result := make([]byte, size)
+	if _, err := syscall.Pread(fdB, result, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, base.Bytes()) || len(b.ModifiedBlocks()) != 0 {
+		t.Error("write leaked to another overlay")
+	}
 }
 
 func TestHTTPGet(t *testing.T) {
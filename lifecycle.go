@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"sync"
+)
+
+// LifecycleBuffer may be implemented in addition to the other buffer
+// interfaces in order to be notified of buffer events.  The methods must
+// not block.
+type LifecycleBuffer interface {
+	// BufferOpened is called when a file handle is opened.
+	BufferOpened()
+
+	// BufferReleased is called when all file handles have been released,
+	// i.e. all file descriptors have been closed and all mappings have been
+	// unmapped.  The buffer won't be read after that.
+	BufferReleased()
+
+	// BufferForgotten is called when the kernel no longer refers to the
+	// buffer, or if buffer creation failed.  It's the last event.
+	BufferForgotten()
+}
+
+// Lifecycle implements LifecycleBuffer.  It can be embedded alongside a
+// buffer implementation:
+//
+//	b := struct {
+//	    *sparse.Buffer
+//	    *lazymem.Lifecycle
+//	}{sparse.NewBuffer(), lazymem.NewLifecycle(ctx)}
+type Lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock      sync.Mutex
+	opened    chan struct{}
+	forgotten chan struct{}
+}
+
+// NewLifecycle with a parent context.
+func NewLifecycle(parent context.Context) *Lifecycle {
+	ctx, cancel := context.WithCancel(parent)
+
+	return &Lifecycle{
+		ctx:       ctx,
+		cancel:    cancel,
+		opened:    make(chan struct{}),
+		forgotten: make(chan struct{}),
+	}
+}
+
+// Context is canceled when the buffer has been released or forgotten, or
+// when the parent context is canceled.  Producers can stop populating the
+// buffer at that point.
+func (l *Lifecycle) Context() context.Context { return l.ctx }
+
+// Opened channel is closed when the buffer is opened for the first time.
+func (l *Lifecycle) Opened() <-chan struct{} { return l.opened }
+
+// Forgotten channel is closed after the last event.
+func (l *Lifecycle) Forgotten() <-chan struct{} { return l.forgotten }
+
+func (l *Lifecycle) BufferOpened() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.opened:
+	default:
+		close(l.opened)
+	}
+}
+
+func (l *Lifecycle) BufferReleased() {
+	l.cancel()
+}
+
+func (l *Lifecycle) BufferForgotten() {
+	l.cancel()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	select {
+	case <-l.forgotten:
+	default:
+		close(l.forgotten)
+	}
+}
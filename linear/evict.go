@@ -0,0 +1,195 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear
+
+// Refetcher repopulates an evicted 128 kB block by writing its content to
+// the target slice.  It is called in a new goroutine.  If it fails, the block
+// remains unavailable and reads of it fail once population has finished.
+type Refetcher func(target []byte, index int) error
+
+// SetRefetcher enables eviction of populated blocks.  Evicted blocks are
+// fetched again when they are read.  It must be called before the buffer is
+// handed to a Manager.  Eviction is suitable only for ClonedBuffer sources,
+// as content written by consumers of a SharedBuffer would be lost.
+func (b *Buffer) SetRefetcher(f Refetcher) {
+	b.refetch = f
+}
+
+// PopulatedBlocks returns the number of blocks currently held in memory.
+func (b *Buffer) PopulatedBlocks() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.count
+}
+
+// EvictBlocks discards the memory of at most max populated blocks which have
+// not been read since the previous call.  Blocks which are being read or
+// written are skipped.  It returns the number of evicted blocks.  It is a
+// no-op if no Refetcher has been set, or for buffers which were not created
+// with NewMappedBuffer or NewMemfdBuffer.
+func (b *Buffer) EvictBlocks(max int) (n int, err error) {
+	if b.refetch == nil || !b.mapped {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// One lap of the clock: recently read blocks get a second chance.
+	total := uint(b.blockCount())
+
+	for scanned := uint(0); scanned < total && n < max; scanned++ {
+		i := b.hand
+		b.hand = (b.hand + 1) % total
+
+		if !b.blockPopulated(i) {
+			continue
+		}
+
+		if getBit(b.touched, i) {
+			clearBit(b.touched, i)
+			continue
+		}
+
+		var ok bool
+
+		ok, err = b.evictBlock(i)
+		if err != nil {
+			return
+		}
+		if ok {
+			n++
+		}
+	}
+	return
+}
+
+// evictBlock spills a populated block if a SpillStore is attached, and
+// discards its memory.  Blocks pinned by readers or writers are skipped.  It
+// must be called with b.lock held.
+func (b *Buffer) evictBlock(i uint) (ok bool, err error) {
+	if b.pins[i] != 0 {
+		return
+	}
+
+	if b.spill != nil {
+		err = b.spill.store(b, i)
+		if err != nil {
+			return
+		}
+	}
+
+	err = b.discard(int(i), int(i)+1)
+	if err != nil {
+		return
+	}
+
+	clearBit(b.bitmap, i)
+	setBit(b.evicted, i)
+	b.count--
+	ok = true
+	return
+}
+
+// waitForResident waits until evicted blocks within a range have been
+// fetched, and pins the range.  Unpopulated blocks are not waited for.  The
+// returned range must be unpinned after the memory has been copied.
+func (b *Buffer) waitForResident(offset int64, length int) (begin, end uint) {
+	begin, end = blockRange(offset, length)
+	if n := uint(b.blockCount()); end > n {
+		end = n
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	hit := true
+	for b.refetchBlocks(begin, end) {
+		hit = false
+		b.cond.Wait()
+	}
+
+	b.accessed(begin, end, hit)
+	b.pinBlocks(begin, end)
+	return
+}
+
+// pinBlocks must be called with b.lock held.
+func (b *Buffer) pinBlocks(begin, end uint) {
+	for i := begin; i < end; i++ {
+		b.pins[i]++
+	}
+}
+
+// unpinBlocks is a no-op if eviction is not enabled.
+func (b *Buffer) unpinBlocks(begin, end uint) {
+	if b.refetch == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i := begin; i < end; i++ {
+		b.pins[i]--
+	}
+}
+
+// accessed must be called with b.lock held.
+func (b *Buffer) accessed(begin, end uint, hit bool) {
+	for i := begin; i < end; i++ {
+		setBit(b.touched, i)
+	}
+
+	if b.spill != nil {
+		b.spill.accessed(b, begin, end, hit)
+	}
+}
+
+// refetchBlocks starts fetching evicted blocks within a range.  It returns
+// true if some blocks are being fetched.  It must be called with b.lock held.
+func (b *Buffer) refetchBlocks(begin, end uint) (pending bool) {
+	for i := begin; i < end; i++ {
+		if !getBit(b.evicted, i) {
+			continue
+		}
+
+		if !getBit(b.fetching, i) {
+			setBit(b.fetching, i)
+			go b.refetchBlock(i)
+		}
+		pending = true
+	}
+	return
+}
+
+func (b *Buffer) refetchBlock(i uint) {
+	err := b.refetch(b.block(i), int(i))
+
+	b.lock.Lock()
+	clearBit(b.fetching, i)
+	clearBit(b.evicted, i)
+	if err == nil && !b.blockPopulated(i) {
+		setBit(b.bitmap, i)
+		setBit(b.touched, i)
+		b.blockAdded()
+	}
+	b.lock.Unlock()
+
+	b.cond.Broadcast()
+}
+
+func (b *Buffer) block(i uint) []byte {
+	block := b.linear[i*BlockSize:]
+	if len(block) > BlockSize {
+		block = block[:BlockSize]
+	}
+	return block
+}
+
+func getBit(bitmap []uint64, i uint) bool { return bitmap[i/64]&(1<<(i&63)) != 0 }
+func setBit(bitmap []uint64, i uint)      { bitmap[i/64] |= 1 << (i & 63) }
+func clearBit(bitmap []uint64, i uint)    { bitmap[i/64] &^= 1 << (i & 63) }
@@ -0,0 +1,58 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tsavola/lazymem/linear"
+)
+
+// TestEvictPinned checks that blocks which are being read are not evicted
+// before they are released.
+func TestEvictPinned(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 2*linear.BlockSize)
+
+	b, err := linear.NewMappedBuffer(len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Free()
+
+	b.SetRefetcher(func(target []byte, index int) error {
+		copy(target, data[index*linear.BlockSize:])
+		return nil
+	})
+
+	copy(b.Bytes(), data)
+	b.BlocksPopulated(0, 2)
+	b.PopulationFinished()
+
+	release, err := b.Pin(10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first pass clears the accessed bit, the second would evict.
+	for i := 0; i < 2; i++ {
+		if _, err := b.EvictBlocks(2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := b.PopulatedBlocks(); n != 1 {
+		t.Errorf("%d populated blocks", n)
+	}
+	if !bytes.Equal(b.Bytes()[10:110], data[10:110]) {
+		t.Error("pinned block was discarded")
+	}
+
+	release()
+
+	if n, err := b.EvictBlocks(2); err != nil || n != 1 {
+		t.Errorf("evicted %d released blocks: %v", n, err)
+	}
+}
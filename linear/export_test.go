@@ -0,0 +1,22 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear
+
+import (
+	"context"
+)
+
+// Pin a range like a read does while it copies the data.
+func (b *Buffer) Pin(offset int64, length int) (release func(), err error) {
+	begin, end := blockRange(offset, length)
+
+	err = b.waitForBlocks(context.Background(), begin, end)
+	if err != nil {
+		return
+	}
+
+	release = func() { b.unpinBlocks(begin, end) }
+	return
+}
@@ -6,20 +6,37 @@
 package linear
 
 import (
+	"context"
 	"io"
+	"runtime/trace"
 	"sync"
 )
 
 const BlockSize = 131072
 
 type Buffer struct {
-	linear []byte
-	closed chan struct{}
+	linear    []byte
+	closed    chan struct{}
+	populated chan struct{}
+	mapped    bool
+	memfd     int
 
 	lock   sync.Mutex
 	cond   sync.Cond
 	bitmap []uint64
+	count  int
 	finish bool
+
+	// Eviction state
+	refetch  Refetcher
+	pins     []int32 // readers and writers copying a block
+	touched  []uint64
+	evicted  []uint64
+	fetching []uint64
+	hand     uint
+	spill    *SpillStore
+	slots    []int64
+	stamps   []uint64
 }
 
 func NewBuffer(linear []byte) (b *Buffer) {
@@ -27,11 +44,21 @@ func NewBuffer(linear []byte) (b *Buffer) {
 	wordLen := (bitLen + 63) / 64
 
 	b = &Buffer{
-		linear: linear,
-		closed: make(chan struct{}),
-		bitmap: make([]uint64, wordLen),
+		linear:    linear,
+		closed:    make(chan struct{}),
+		populated: make(chan struct{}),
+		memfd:     -1,
+		bitmap:    make([]uint64, wordLen),
+		pins:      make([]int32, bitLen),
+		touched:   make([]uint64, wordLen),
+		evicted:   make([]uint64, wordLen),
+		fetching:  make([]uint64, wordLen),
 	}
 	b.cond.L = &b.lock
+
+	if bitLen == 0 {
+		close(b.populated)
+	}
 	return
 }
 
@@ -39,46 +66,126 @@ func (b *Buffer) Bytes() []byte           { return b.linear }
 func (b *Buffer) Len() int                { return len(b.linear) }
 func (b *Buffer) Closed() <-chan struct{} { return b.closed }
 
-func (b *Buffer) ReadAt(target []byte, sourceOffset int64) (n int, err error) {
-	if !b.waitForBlocks(sourceOffset, len(target)) {
-		err = io.EOF
+// Populated channel is closed when all blocks have become available.
+func (b *Buffer) Populated() <-chan struct{} { return b.populated }
+
+func (b *Buffer) ReadAt(target []byte, sourceOffset int64) (int, error) {
+	return b.ReadAtContext(context.Background(), target, sourceOffset)
+}
+
+// ReadAtContext is like ReadAt.  If the read has to wait for population, the
+// wait is traced as a region of the context's runtime/trace task, and it's
+// interrupted with the context's error when the context is done.
+func (b *Buffer) ReadAtContext(ctx context.Context, target []byte, sourceOffset int64) (n int, err error) {
+	begin, end := blockRange(sourceOffset, len(target))
+
+	err = b.waitForBlocks(ctx, begin, end)
+	if err != nil {
 		return
 	}
 
 	n = copy(target, b.linear[sourceOffset:])
+	b.unpinBlocks(begin, end)
 	return
 }
 
-func (b *Buffer) waitForBlocks(offset int64, length int) bool {
-	begin := uint((offset + BlockSize - 1) / BlockSize)
-	end := uint((offset + int64(length) + BlockSize - 1) / BlockSize)
+// blockRange returns the indexes of the blocks which overlap with a byte
+// range.  A partially covered block at either end is included.
+func blockRange(offset int64, length int) (begin, end uint) {
+	begin = uint(offset / BlockSize)
+	end = uint((offset + int64(length) + BlockSize - 1) / BlockSize)
+	return
+}
 
+// waitForBlocks pins the blocks if eviction is enabled.  They must be
+// unpinned after the memory has been copied.  The error is io.EOF if the
+// blocks won't be populated, or the context's error.
+func (b *Buffer) waitForBlocks(ctx context.Context, begin, end uint) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
+	var (
+		region *trace.Region
+		stop   func() bool
+	)
+	defer func() {
+		if region != nil {
+			region.End()
+		}
+		if stop != nil {
+			stop()
+		}
+	}()
+
+	hit := true
+
 	for {
 		if b.checkForBlocks(begin, end) {
-			return true
+			if b.refetch != nil {
+				b.accessed(begin, end, hit)
+				b.pinBlocks(begin, end)
+			}
+			return nil
 		}
-		if b.finish {
-			return false
+		pending := b.refetch != nil && b.refetchBlocks(begin, end)
+		if b.finish && !pending {
+			return io.EOF
+		}
+		if pending {
+			hit = false
+		}
+
+		if region == nil {
+			region = trace.StartRegion(ctx, "linear.waitForBlocks")
+			if trace.IsEnabled() {
+				trace.Logf(ctx, "blocks", "%d-%d", begin, end)
+			}
+
+			stop = context.AfterFunc(ctx, b.wake)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
 		b.cond.Wait()
 	}
 }
 
+func (b *Buffer) wake() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.cond.Broadcast()
+}
+
 func (b *Buffer) checkForBlocks(begin, end uint) bool {
 	for i := begin; i < end; i++ {
-		if b.bitmap[i/64]&(1<<(i&63)) == 0 {
+		if !b.blockPopulated(i) {
 			return false
 		}
 	}
 	return true
 }
 
+// blockPopulated must be called with b.lock held.
+func (b *Buffer) blockPopulated(i uint) bool {
+	return b.bitmap[i/64]&(1<<(i&63)) != 0
+}
+
+func (b *Buffer) blockCount() int {
+	return (len(b.linear) + BlockSize - 1) / BlockSize
+}
+
 func (b *Buffer) WriteAt(source []byte, targetOffset int64) (n int, err error) {
+	if b.refetch == nil {
+		n = copy(b.linear[targetOffset:], source)
+		return
+	}
+
+	begin, end := b.waitForResident(targetOffset, len(source))
 	n = copy(b.linear[targetOffset:], source)
+	b.unpinBlocks(begin, end)
 	return
 }
 
@@ -97,7 +204,10 @@ func (b *Buffer) BlockPopulated(index int) {
 	}
 
 	b.lock.Lock()
-	b.bitmap[word] |= mask
+	if b.bitmap[word]&mask == 0 {
+		b.bitmap[word] |= mask
+		b.blockAdded()
+	}
 	b.lock.Unlock()
 
 	b.cond.Broadcast()
@@ -117,13 +227,29 @@ func (b *Buffer) BlocksPopulated(index, count int) {
 
 	b.lock.Lock()
 	for i := index; i < index+count; i++ {
-		b.bitmap[i/64] |= 1 << uint(i&63)
+		if !b.blockPopulated(uint(i)) {
+			b.bitmap[i/64] |= 1 << uint(i&63)
+			b.blockAdded()
+		}
 	}
 	b.lock.Unlock()
 
 	b.cond.Broadcast()
 }
 
+// blockAdded must be called with b.lock held.
+func (b *Buffer) blockAdded() {
+	b.count++
+	if b.count == b.blockCount() {
+		select {
+		case <-b.populated:
+			// repopulated after eviction
+		default:
+			close(b.populated)
+		}
+	}
+}
+
 // PopulationFinished indicates that no more blocks will become available,
 // either because all have been populated, or due to cancellation or error.
 func (b *Buffer) PopulationFinished() {
@@ -0,0 +1,38 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/tsavola/lazymem/linear"
+)
+
+// TestUnalignedRead checks that a read which starts in the middle of a block
+// waits for that block too.
+func TestUnalignedRead(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 2*linear.BlockSize)
+
+	b := linear.NewBuffer(data)
+	b.BlockPopulated(1)
+	b.PopulationFinished()
+
+	result := make([]byte, 10)
+
+	if _, err := b.ReadAt(result, linear.BlockSize-5); err != io.EOF {
+		t.Errorf("read of unpopulated block: %v", err)
+	}
+
+	b.BlockPopulated(0)
+
+	if _, err := b.ReadAt(result, linear.BlockSize-5); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, data[:10]) {
+		t.Error("content mismatch")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear
+
+import (
+	"syscall"
+
+	"github.com/tsavola/lazymem/internal/memfd"
+)
+
+// NewMappedBuffer allocates the buffer memory outside of the Go heap, as an
+// anonymous private mapping.  The memory must be released with Free.
+func NewMappedBuffer(size int) (b *Buffer, err error) {
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return
+	}
+
+	b = NewBuffer(mem)
+	b.mapped = true
+	return
+}
+
+// NewMemfdBuffer allocates the buffer memory outside of the Go heap, as a
+// shared mapping of a memory file.  The memory must be released with Free.
+func NewMemfdBuffer(name string, size int) (b *Buffer, err error) {
+	fd, err := memfd.Create(name, memfd.CLOEXEC)
+	if err != nil {
+		return
+	}
+
+	err = syscall.Ftruncate(fd, int64(size))
+	if err != nil {
+		syscall.Close(fd)
+		return
+	}
+
+	mem, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(fd)
+		return
+	}
+
+	b = NewBuffer(mem)
+	b.mapped = true
+	b.memfd = fd
+	return
+}
+
+// Fd of the memory file of a buffer created with NewMemfdBuffer, or -1.  It
+// is closed by Free.
+func (b *Buffer) Fd() int {
+	return b.memfd
+}
+
+// ReleaseBlocks discards the memory of unpopulated 128 kB blocks.  Populated
+// blocks within the range are left alone.  Released blocks read as zeros
+// until they are written again.  It is a no-op for buffers which were not
+// created with NewMappedBuffer or NewMemfdBuffer.
+func (b *Buffer) ReleaseBlocks(index, count int) (err error) {
+	if index < 0 || count < 0 || index+count > b.blockCount() {
+		panic("block index or count out of bounds")
+	}
+
+	if !b.mapped {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i := index; i < index+count; {
+		if b.blockPopulated(uint(i)) {
+			i++
+			continue
+		}
+
+		begin := i
+		for i < index+count && !b.blockPopulated(uint(i)) {
+			i++
+		}
+
+		err = b.discard(begin, i)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// discard must be called with b.lock held.
+func (b *Buffer) discard(beginBlock, endBlock int) error {
+	mem := b.linear[beginBlock*BlockSize:]
+	if n := (endBlock - beginBlock) * BlockSize; n < len(mem) {
+		mem = mem[:n]
+	}
+
+	advice := syscall.MADV_DONTNEED
+	if b.memfd >= 0 {
+		advice = syscall.MADV_REMOVE // shared memory isn't released otherwise
+	}
+
+	return syscall.Madvise(mem, advice)
+}
+
+// Free the memory of a buffer created with NewMappedBuffer or NewMemfdBuffer.
+// The buffer must not be used afterwards.  It is a no-op for other buffers.
+func (b *Buffer) Free() (err error) {
+	if !b.mapped {
+		return
+	}
+
+	err = syscall.Munmap(b.linear)
+	b.linear = nil
+	b.mapped = false
+
+	if b.memfd >= 0 {
+		if e := syscall.Close(b.memfd); err == nil {
+			err = e
+		}
+		b.memfd = -1
+	}
+	return
+}
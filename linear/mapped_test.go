@@ -0,0 +1,101 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tsavola/lazymem/linear"
+)
+
+func TestReleaseBlocksMapped(t *testing.T) {
+	testReleaseBlocks(t, func(size int) (*linear.Buffer, error) {
+		return linear.NewMappedBuffer(size)
+	})
+}
+
+func TestReleaseBlocksMemfd(t *testing.T) {
+	testReleaseBlocks(t, func(size int) (*linear.Buffer, error) {
+		return linear.NewMemfdBuffer("lazymem-test", size)
+	})
+}
+
+func testReleaseBlocks(t *testing.T, newBuffer func(int) (*linear.Buffer, error)) {
+	const blocks = 4
+
+	b, err := newBuffer(blocks*linear.BlockSize - 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Free()
+
+	data := b.Bytes()
+	for i := range data {
+		data[i] = byte(i*5) | 1
+	}
+	expect := append([]byte(nil), data...)
+
+	b.BlockPopulated(1)
+
+	if err := b.ReleaseBlocks(0, blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := b.PopulatedBlocks(); n != 1 {
+		t.Errorf("%d populated blocks after release", n)
+	}
+
+	block := func(i int) []byte {
+		end := (i + 1) * linear.BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		return data[i*linear.BlockSize : end]
+	}
+
+	for i := 0; i < blocks; i++ {
+		if i == 1 {
+			if !bytes.Equal(block(i), expect[linear.BlockSize:2*linear.BlockSize]) {
+				t.Error("populated block was released")
+			}
+			continue
+		}
+
+		if bytes.Count(block(i), []byte{0}) != len(block(i)) {
+			t.Errorf("block %d not released", i)
+		}
+	}
+
+	// Populate the released blocks again.
+	copy(data, expect)
+	b.BlocksPopulated(0, blocks)
+	b.PopulationFinished()
+
+	if n := b.PopulatedBlocks(); n != blocks {
+		t.Errorf("%d populated blocks after repopulation", n)
+	}
+
+	select {
+	case <-b.Populated():
+	default:
+		t.Error("not populated")
+	}
+
+	result := make([]byte, len(expect))
+	if _, err := b.ReadAt(result, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, expect) {
+		t.Error("content mismatch after repopulation")
+	}
+
+	if err := b.ReleaseBlocks(0, blocks); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expect) {
+		t.Error("populated blocks were released")
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpillStats are cumulative, except for the byte counts.
+type SpillStats struct {
+	Hits    uint64 // accesses which found their blocks in memory
+	Misses  uint64 // accesses which had to wait for reloading
+	Spills  uint64 // blocks written to the file
+	Reloads uint64 // blocks read back from the file
+
+	ResidentBytes int64 // populated blocks in memory
+	SpilledBytes  int64 // blocks in the file
+}
+
+// SpillStore moves cold blocks of buffers to a scratch file when their total
+// size exceeds a budget, and reloads them when they are accessed.  Unlike
+// eviction, it preserves content written by consumers of shared buffers.
+type SpillStore struct {
+	file   *os.File
+	budget int64
+
+	lock    sync.Mutex
+	buffers []*Buffer
+	mark    uint64 // clock value at previous Collect
+
+	slotLock sync.Mutex
+	slots    int64   // allocated file size in blocks
+	free     []int64 // unused slots
+
+	clock   uint64 // atomic; incremented by accesses
+	hits    uint64 // atomic
+	misses  uint64 // atomic
+	spills  uint64 // atomic
+	reloads uint64 // atomic
+}
+
+// NewSpillStore creates an unlinked scratch file in a directory (the
+// default temporary directory if empty).  Budget limits the total size of
+// populated blocks kept in memory, in bytes.
+func NewSpillStore(dir string, budget int64) (s *SpillStore, err error) {
+	f, err := ioutil.TempFile(dir, "lazymem-spill-")
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(f.Name())
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	s = &SpillStore{
+		file:   f,
+		budget: budget,
+	}
+	return
+}
+
+// Close the scratch file.  The attached buffers must not be accessed
+// afterwards.
+func (s *SpillStore) Close() error {
+	return s.file.Close()
+}
+
+// Attach a buffer created with NewMappedBuffer or NewMemfdBuffer, before it
+// is populated.  It is detached when it's closed.  Spilling replaces any
+// Refetcher.
+//
+// Only writes made via WriteAt are preserved.  The host must not modify
+// populated blocks via Bytes, as a concurrent Collect may discard the
+// modification, or it may be overwritten when a spilled block is reloaded.
+func (s *SpillStore) Attach(b *Buffer) error {
+	if !b.mapped {
+		return errors.New("linear: spilling requires a mapped buffer")
+	}
+
+	b.spill = s
+	b.slots = make([]int64, b.blockCount())
+	b.stamps = make([]uint64, b.blockCount())
+	b.refetch = func(target []byte, index int) error {
+		return s.reload(b, target, index)
+	}
+
+	s.lock.Lock()
+	s.buffers = append(s.buffers, b)
+	s.lock.Unlock()
+
+	go func() {
+		<-b.Closed()
+		s.detach(b)
+	}()
+	return nil
+}
+
+func (s *SpillStore) detach(b *Buffer) {
+	s.lock.Lock()
+	for i, x := range s.buffers {
+		if x == b {
+			s.buffers = append(s.buffers[:i], s.buffers[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i := range b.slots {
+		if getBit(b.evicted, uint(i)) && !getBit(b.fetching, uint(i)) {
+			clearBit(b.evicted, uint(i))
+			s.freeSlot(b.slots[i])
+		}
+	}
+}
+
+// Stats snapshot.
+func (s *SpillStore) Stats() (stats SpillStats) {
+	stats.Hits = atomic.LoadUint64(&s.hits)
+	stats.Misses = atomic.LoadUint64(&s.misses)
+	stats.Spills = atomic.LoadUint64(&s.spills)
+	stats.Reloads = atomic.LoadUint64(&s.reloads)
+
+	s.lock.Lock()
+	for _, b := range s.buffers {
+		stats.ResidentBytes += int64(b.PopulatedBlocks()) * BlockSize
+	}
+	s.lock.Unlock()
+
+	s.slotLock.Lock()
+	stats.SpilledBytes = (s.slots - int64(len(s.free))) * BlockSize
+	s.slotLock.Unlock()
+	return
+}
+
+// Run Collect periodically until the context is done.
+func (s *SpillStore) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.Collect(); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type spillCandidate struct {
+	b     *Buffer
+	index uint
+	stamp uint64
+}
+
+// Collect spills least recently used blocks until the budget is met.  Blocks
+// accessed since the previous call are not spilled, and neither are blocks
+// which are being read or written.  It returns the number of spilled blocks.
+func (s *SpillStore) Collect() (spilled int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mark := s.mark
+	s.mark = atomic.LoadUint64(&s.clock)
+
+	var (
+		resident   int64
+		candidates []spillCandidate
+	)
+
+	for _, b := range s.buffers {
+		b.lock.Lock()
+		resident += int64(b.count) * BlockSize
+		for i := uint(0); i < uint(len(b.stamps)); i++ {
+			if b.blockPopulated(i) && b.stamps[i] <= mark {
+				candidates = append(candidates, spillCandidate{b, i, b.stamps[i]})
+			}
+		}
+		b.lock.Unlock()
+	}
+
+	if resident <= s.budget {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].stamp < candidates[j].stamp
+	})
+
+	for _, c := range candidates {
+		if resident <= s.budget {
+			break
+		}
+
+		var ok bool
+
+		c.b.lock.Lock()
+		if c.b.blockPopulated(c.index) && c.b.stamps[c.index] == c.stamp {
+			ok, err = c.b.evictBlock(c.index)
+		}
+		c.b.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+		if ok {
+			resident -= BlockSize
+			spilled++
+		}
+	}
+	return
+}
+
+// store a block in the file.  It must be called with b.lock held.
+func (s *SpillStore) store(b *Buffer, i uint) (err error) {
+	slot := s.allocSlot()
+
+	_, err = s.file.WriteAt(b.block(i), slot*BlockSize)
+	if err != nil {
+		s.freeSlot(slot)
+		return
+	}
+
+	b.slots[i] = slot
+	atomic.AddUint64(&s.spills, 1)
+	return
+}
+
+func (s *SpillStore) reload(b *Buffer, target []byte, index int) (err error) {
+	b.lock.Lock()
+	slot := b.slots[index]
+	b.lock.Unlock()
+
+	_, err = s.file.ReadAt(target, slot*BlockSize)
+	if err != nil {
+		return
+	}
+
+	s.freeSlot(slot)
+	atomic.AddUint64(&s.reloads, 1)
+	return
+}
+
+func (s *SpillStore) allocSlot() (slot int64) {
+	s.slotLock.Lock()
+	defer s.slotLock.Unlock()
+
+	if n := len(s.free); n > 0 {
+		slot = s.free[n-1]
+		s.free = s.free[:n-1]
+	} else {
+		slot = s.slots
+		s.slots++
+	}
+	return
+}
+
+func (s *SpillStore) freeSlot(slot int64) {
+	s.slotLock.Lock()
+	defer s.slotLock.Unlock()
+
+	s.free = append(s.free, slot)
+}
+
+// accessed must be called with b.lock held.
+func (s *SpillStore) accessed(b *Buffer, begin, end uint, hit bool) {
+	stamp := atomic.AddUint64(&s.clock, 1)
+	for i := begin; i < end && i < uint(len(b.stamps)); i++ {
+		b.stamps[i] = stamp
+	}
+
+	if hit {
+		atomic.AddUint64(&s.hits, 1)
+	} else {
+		atomic.AddUint64(&s.misses, 1)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linear_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tsavola/lazymem/linear"
+)
+
+func TestSpill(t *testing.T) {
+	const blocks = 4
+
+	s, err := linear.NewSpillStore(t.TempDir(), linear.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b, err := linear.NewMappedBuffer(blocks*linear.BlockSize - 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Free()
+
+	if err := s.Attach(b); err != nil {
+		t.Fatal(err)
+	}
+
+	data := b.Bytes()
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	expect := append([]byte(nil), data...)
+
+	b.BlocksPopulated(0, blocks)
+	b.PopulationFinished()
+
+	if n, err := s.Collect(); err != nil || n != blocks-1 {
+		t.Fatalf("spilled %d: %v", n, err)
+	}
+
+	stats := s.Stats()
+	if stats.Spills != blocks-1 || stats.SpilledBytes != (blocks-1)*linear.BlockSize || stats.ResidentBytes != linear.BlockSize {
+		t.Errorf("%+v", stats)
+	}
+
+	result := make([]byte, len(expect))
+	if _, err := b.ReadAt(result, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, expect) {
+		t.Error("content mismatch after reload")
+	}
+
+	stats = s.Stats()
+	if stats.Reloads != blocks-1 || stats.Misses != 1 || stats.SpilledBytes != 0 {
+		t.Errorf("%+v", stats)
+	}
+
+	// Everything was just accessed.
+	if n, _ := s.Collect(); n != 0 {
+		t.Errorf("spilled %d recently accessed blocks", n)
+	}
+
+	// Block 3 is the most recently used.
+	b.ReadAt(result[:10], 3*linear.BlockSize)
+
+	if n, _ := s.Collect(); n != blocks-1 {
+		t.Errorf("spilled %d blocks", n)
+	}
+
+	// Writes must not be lost.
+	patch := []byte("written by a consumer")
+	if _, err := b.WriteAt(patch, linear.BlockSize+10); err != nil {
+		t.Fatal(err)
+	}
+	copy(expect[linear.BlockSize+10:], patch)
+
+	if _, err := b.ReadAt(result, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, expect) {
+		t.Error("content mismatch after write")
+	}
+}
+
+// TestSpillPinned checks that blocks which are being accessed are not
+// spilled, even if they haven't been accessed recently.
+func TestSpillPinned(t *testing.T) {
+	const blocks = 2
+
+	s, err := linear.NewSpillStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b, err := linear.NewMappedBuffer(blocks * linear.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Free()
+
+	if err := s.Attach(b); err != nil {
+		t.Fatal(err)
+	}
+
+	b.BlocksPopulated(0, blocks)
+	b.PopulationFinished()
+
+	release, err := b.Pin(linear.BlockSize, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first call spills the other block, and sets the mark after the
+	// access.
+	if n, err := s.Collect(); err != nil || n != 1 {
+		t.Errorf("spilled %d: %v", n, err)
+	}
+
+	if n, err := s.Collect(); err != nil || n != 0 {
+		t.Errorf("spilled %d pinned blocks: %v", n, err)
+	}
+
+	release()
+
+	if n, err := s.Collect(); err != nil || n != 1 {
+		t.Errorf("spilled %d released blocks: %v", n, err)
+	}
+}
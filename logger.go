@@ -5,7 +5,11 @@
 package lazymem
 
 import (
+	"context"
 	"log"
+	"log/slog"
+
+	"github.com/jacobsa/fuse/fuseops"
 )
 
 // Logger for error and/or debug messages.  Subset of log.Logger.
@@ -36,3 +40,98 @@ func adaptLogger(x Logger) (l *log.Logger) {
 	l = log.New(logWriter{x}, "", 0)
 	return
 }
+
+// Attribute keys of structured log events.
+const (
+	LogKeyInode  = "inode"
+	LogKeySize   = "size"
+	LogKeyKind   = "kind"
+	LogKeyPid    = "pid"
+	LogKeyOffset = "offset"
+	LogKeyLength = "length"
+)
+
+// newEventLogger for structured events.  Config.LogHandler is used if set.
+// Otherwise warnings and errors are formatted to ErrorLog, and other events
+// to DebugLog.
+func newEventLogger(c *Config) *slog.Logger {
+	if c.LogHandler != nil {
+		return slog.New(c.LogHandler)
+	}
+
+	var h printfHandler
+
+	if c.ErrorLog != nil {
+		h.error = newPrintfHandler(c.ErrorLog, slog.LevelWarn)
+	}
+	if c.DebugLog != nil {
+		h.debug = newPrintfHandler(c.DebugLog, slog.LevelDebug)
+	}
+
+	return slog.New(h)
+}
+
+func newPrintfHandler(l Logger, level slog.Level) slog.Handler {
+	return slog.NewTextHandler(logWriter{l}, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{} // Logger adds its own
+			}
+			return a
+		},
+	})
+}
+
+// printfHandler dispatches events to the legacy loggers by level.
+type printfHandler struct {
+	error slog.Handler
+	debug slog.Handler
+}
+
+func (h printfHandler) handler(level slog.Level) slog.Handler {
+	if level >= slog.LevelWarn && h.error != nil {
+		return h.error
+	}
+	return h.debug
+}
+
+func (h printfHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	x := h.handler(level)
+	return x != nil && x.Enabled(ctx, level)
+}
+
+func (h printfHandler) Handle(ctx context.Context, r slog.Record) error {
+	if x := h.handler(r.Level); x != nil {
+		return x.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h printfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if h.error != nil {
+		h.error = h.error.WithAttrs(attrs)
+	}
+	if h.debug != nil {
+		h.debug = h.debug.WithAttrs(attrs)
+	}
+	return h
+}
+
+func (h printfHandler) WithGroup(name string) slog.Handler {
+	if h.error != nil {
+		h.error = h.error.WithGroup(name)
+	}
+	if h.debug != nil {
+		h.debug = h.debug.WithGroup(name)
+	}
+	return h
+}
+
+func nodeAttrs(id fuseops.InodeID, b *buffer, more ...slog.Attr) []slog.Attr {
+	return append([]slog.Attr{
+		slog.Uint64(LogKeyInode, uint64(id)),
+		slog.Int64(LogKeySize, b.size),
+		slog.String(LogKeyKind, b.kind.String()),
+	}, more...)
+}
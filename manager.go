@@ -6,11 +6,10 @@ package lazymem
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
 	"os"
-
-	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fuseutil"
+	"sync"
+	"time"
 )
 
 // Config for the memory filesystem.
@@ -18,16 +17,78 @@ type Config struct {
 	Mountpoint string
 	ErrorLog   Logger
 	DebugLog   Logger
+
+	// LogHandler receives structured events.  If it's nil, the events are
+	// formatted to ErrorLog and DebugLog.  The FUSE binding's own messages
+	// still go to ErrorLog and DebugLog; if ErrorLog is nil, errors go to
+	// LogHandler.
+	LogHandler slog.Handler
+
+	// StallThreshold is the duration after which a slow read is logged as
+	// a stall.  Defaults to one second.  Stalls and read errors are warnings
+	// and errors for LogHandler, but they go to DebugLog if LogHandler is
+	// nil.
+	StallThreshold time.Duration
+
+	// PromoteCloned enables copying of fully populated cloned buffers to
+	// sealed memory files.  See CreateCloned.
+	PromoteCloned bool
+
+	// FSName is displayed by mount(8).  Defaults to "lazymem".
+	FSName string
+
+	// ReadOnly mount.  Only O_RDONLY buffers can be created.
+	ReadOnly bool
+
+	// DisableWritebackCaching makes writes to shared mappings reach the
+	// SharedBuffer synchronously, instead of via the kernel's page cache.
+	DisableWritebackCaching bool
+
+	// MaxRead limits the size of read requests.  It must be a multiple of
+	// the page size, and at most 128 kB.  Zero means the maximum.
+	MaxRead int
+
+	// MaxReadahead limits how much the kernel reads ahead of page faults.
+	// It must be a multiple of the page size, and at most 1 MB.  Zero leaves
+	// the kernel's default.  Adjusting it requires write access to
+	// /sys/class/bdi.
+	MaxReadahead int
+
+	// MaxPages limits the total size of live buffers, in pages.  MaxBuffers
+	// limits their number.  Zero means unlimited.  Exceeding a limit causes
+	// buffer creation to fail with QuotaError.
+	MaxPages   uint64
+	MaxBuffers uint64
+
+	// DetachOnShutdown makes Shutdown lazily unmount the filesystem if
+	// buffers are still in use when its context is done.  AbortOnShutdown
+	// additionally aborts the FUSE connection.  See ShutdownOutcome.
+	DetachOnShutdown bool
+	AbortOnShutdown  bool
+
+	// Remount makes buffer creation mount the filesystem again if it has
+	// been unmounted by someone else, or if the FUSE connection has been
+	// aborted.  Buffers created before that are lost.
+	Remount bool
+
+	// MountOptions are passed to the mount helper in addition to the
+	// options derived from the other fields.
+	MountOptions map[string]string
 }
 
 // Manager of lazy memory.  It is backed by a custom filesystem implementation.
 type Manager struct {
 	Config
 
-	fs     *fileSystem
-	server fuse.Server
-	rmdir  bool
-	mount  *fuse.MountedFileSystem
+	ctx   context.Context
+	log   *slog.Logger
+	rmdir bool
+
+	lock    sync.Mutex
+	s       *session
+	closing bool
+
+	remountLock sync.Mutex
 }
 
 // New mounts a filesystem instance.
@@ -38,53 +99,41 @@ func New(ctx context.Context, config *Config) (m *Manager, err error) {
 		m.Config = *config
 	}
 
-	if m.Mountpoint == "" {
-		runDir := os.Getenv("XDG_RUNTIME_DIR")
-		if runDir == "" {
-			runDir = "/run"
-		}
-		m.Mountpoint = fmt.Sprintf("%s/lazymem/%d", runDir, os.Getpid())
-	}
-
-	m.fs, err = newFileSystem()
+	err = m.Config.validate()
 	if err != nil {
+		err = &PreflightError{Err: ErrInvalidConfig, Cause: err}
 		return
 	}
 
-	m.server = fuseutil.NewFileSystemServer(m.fs)
-
-	err = os.MkdirAll(m.Mountpoint, 0700)
-	if err == nil {
-		m.rmdir = true
-	} else if !os.IsExist(err) {
-		return
+	defaulted := m.Mountpoint == ""
+	if defaulted {
+		m.Mountpoint = defaultMountpoint()
 	}
 
-	mountConfig := fuse.MountConfig{
-		OpContext:   ctx,
-		FSName:      "lazymem",
-		Subtype:     "lazymem",
-		ErrorLogger: adaptLogger(m.ErrorLog),
-		DebugLogger: adaptLogger(m.DebugLog),
+	if m.StallThreshold <= 0 {
+		m.StallThreshold = time.Second
 	}
 
-	m.mount, err = fuse.Mount(m.Mountpoint, m.server, &mountConfig)
-	if err != nil {
-		m.cleanup()
-	}
-	return
-}
+	m.ctx = ctx
+	m.log = newEventLogger(&m.Config)
 
-// Shutdown unmounts the filesystem.
-func (m *Manager) Shutdown(ctx context.Context) (err error) {
-	err = fuse.Unmount(m.mount.Dir())
-
-	if e := m.mount.Join(ctx); err == nil {
-		err = e
+	// Only a directory created here is removed by Shutdown, as an existing
+	// one may have content.
+	_, err = os.Stat(m.Mountpoint)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(m.Mountpoint, 0700)
+		m.rmdir = err == nil
+	}
+	if err != nil {
+		if e := checkMountpoint(m.Mountpoint, defaulted); e != nil {
+			err = e
+		}
+		return
 	}
 
-	if e := m.cleanup(); err == nil {
-		err = e
+	m.s, err = m.mount(ctx)
+	if err != nil {
+		m.cleanup()
 	}
 	return
 }
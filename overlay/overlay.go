@@ -0,0 +1,219 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package overlay implements SharedBuffer on top of a read-only base, which
+// may be shared by many overlays.  Written blocks are stored separately for
+// each overlay.
+package overlay
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/tsavola/lazymem/internal/wrap"
+)
+
+// BlockSize is the granularity of the block store.
+const BlockSize = 4096
+
+// Buffer reads unmodified blocks from the base.  It implements io.ReaderAt,
+// io.WriterAt, io.Closer and ReadAtContext.
+type Buffer struct {
+	base io.ReaderAt
+	size int64
+
+	lock   sync.RWMutex // guards the map and the contents of the blocks
+	blocks map[int64][]byte
+}
+
+// New overlay of a base buffer, such as a linear.Buffer which is also passed
+// to Manager.CreateCloned.  The base is not closed by the overlay.
+func New(base io.ReaderAt, size int64) *Buffer {
+	return &Buffer{
+		base:   base,
+		size:   size,
+		blocks: make(map[int64][]byte),
+	}
+}
+
+func (b *Buffer) Len() int64 { return b.size }
+
+// block returns the modified block, or nil.  Its contents must be accessed
+// while holding the lock.
+func (b *Buffer) block(index int64) []byte {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.blocks[index]
+}
+
+// readBlock copies from a modified block.  It returns false if the block
+// hasn't been modified.
+func (b *Buffer) readBlock(dest []byte, index int64, offset int) (n int, found bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	data := b.blocks[index]
+	if data == nil {
+		return
+	}
+
+	n = copy(dest, data[offset:])
+	found = true
+	return
+}
+
+func (b *Buffer) ReadAt(dest []byte, offset int64) (int, error) {
+	return b.ReadAtContext(context.Background(), dest, offset)
+}
+
+// ReadAtContext is like ReadAt.  The context is passed to the base if it
+// implements ReadAtContext.
+func (b *Buffer) ReadAtContext(ctx context.Context, dest []byte, offset int64) (n int, err error) {
+	if offset >= b.size {
+		err = io.EOF
+		return
+	}
+	if int64(len(dest)) > b.size-offset {
+		dest = dest[:b.size-offset]
+		defer func() {
+			if err == nil {
+				err = io.EOF
+			}
+		}()
+	}
+
+	for len(dest) > 0 {
+		index := offset / BlockSize
+		o := int(offset % BlockSize)
+
+		m, found := b.readBlock(dest, index, o)
+		if !found {
+			// Read through to the base until the next modified block.
+			m = BlockSize - o
+			for next := index + 1; m < len(dest) && b.block(next) == nil; next++ {
+				m += BlockSize
+			}
+			if m > len(dest) {
+				m = len(dest)
+			}
+
+			m, err = wrap.ReadAtContext(ctx, b.base, dest[:m], offset)
+			if err == io.EOF && offset+int64(m) == b.size {
+				err = nil
+			}
+		}
+
+		n += m
+		if err != nil {
+			return
+		}
+
+		dest = dest[m:]
+		offset += int64(m)
+	}
+	return
+}
+
+// WriteAt writes up to the end of the buffer.  The error is io.EOF if the
+// source extends past it.
+func (b *Buffer) WriteAt(source []byte, offset int64) (n int, err error) {
+	if offset >= b.size {
+		err = io.EOF
+		return
+	}
+	if int64(len(source)) > b.size-offset {
+		source = source[:b.size-offset]
+		defer func() {
+			if err == nil {
+				err = io.EOF
+			}
+		}()
+	}
+
+	for len(source) > 0 {
+		index := offset / BlockSize
+		o := int(offset % BlockSize)
+
+		data := b.block(index)
+		if data == nil {
+			data, err = b.copyUp(index)
+			if err != nil {
+				return
+			}
+		}
+
+		b.lock.Lock()
+		m := copy(data[o:], source)
+		b.lock.Unlock()
+
+		n += m
+		source = source[m:]
+		offset += int64(m)
+	}
+	return
+}
+
+// copyUp a block from the base to the block store.
+func (b *Buffer) copyUp(index int64) (data []byte, err error) {
+	data = make([]byte, BlockSize)
+
+	length := BlockSize
+	if end := (index + 1) * BlockSize; end > b.size {
+		length -= int(end - b.size)
+	}
+
+	n, err := b.base.ReadAt(data[:length], index*BlockSize)
+	if n == length {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if existing := b.blocks[index]; existing != nil {
+		data = existing // lost a race
+	} else {
+		b.blocks[index] = data
+	}
+	return
+}
+
+// Modified reports if a block has been written to.
+func (b *Buffer) Modified(index int64) bool {
+	return b.block(index) != nil
+}
+
+// ModifiedBlocks returns the indexes of the blocks which have been written
+// to, in ascending order.
+func (b *Buffer) ModifiedBlocks() (indexes []int64) {
+	b.lock.RLock()
+	indexes = make([]int64, 0, len(b.blocks))
+	for i := range b.blocks {
+		indexes = append(indexes, i)
+	}
+	b.lock.RUnlock()
+
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return
+}
+
+// ModifiedBytes returns the size of the block store.
+func (b *Buffer) ModifiedBytes() int64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return int64(len(b.blocks)) * BlockSize
+}
+
+// Close does nothing.  Modified content can still be read and queried after
+// the consumers are done with the buffer.
+func (b *Buffer) Close() error {
+	return nil
+}
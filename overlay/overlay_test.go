@@ -0,0 +1,129 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package overlay_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tsavola/lazymem/linear"
+	"github.com/tsavola/lazymem/overlay"
+)
+
+func TestOverlay(t *testing.T) {
+	const size = 3*overlay.BlockSize + 100
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 11)
+	}
+
+	base := linear.NewBuffer(append([]byte(nil), data...))
+	base.BlocksPopulated(0, 1)
+	base.PopulationFinished()
+
+	a := overlay.New(base, size)
+	b := overlay.New(base, size)
+
+	patch := bytes.Repeat([]byte{0xff}, overlay.BlockSize)
+	if _, err := a.WriteAt(patch, overlay.BlockSize/2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.WriteAt([]byte{1, 2, 3}, size-3); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := append([]byte(nil), data...)
+	copy(expect[overlay.BlockSize/2:], patch)
+	copy(expect[size-3:], []byte{1, 2, 3})
+
+	result := make([]byte, size+10)
+
+	n, err := a.ReadAt(result, 0)
+	if n != size || err != io.EOF {
+		t.Errorf("read: %d, %v", n, err)
+	}
+	if !bytes.Equal(result[:size], expect) {
+		t.Error("overlay content mismatch")
+	}
+
+	if _, err := b.ReadAt(result[:size], 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result[:size], data) {
+		t.Error("write leaked to another overlay")
+	}
+	if !bytes.Equal(base.Bytes(), data) {
+		t.Error("base modified")
+	}
+
+	if blocks := a.ModifiedBlocks(); !reflect.DeepEqual(blocks, []int64{0, 1, 3}) {
+		t.Errorf("modified blocks: %v", blocks)
+	}
+	if !a.Modified(3) || a.Modified(2) || len(b.ModifiedBlocks()) != 0 {
+		t.Error("modification query mismatch")
+	}
+	if a.ModifiedBytes() != 3*overlay.BlockSize {
+		t.Errorf("modified bytes: %d", a.ModifiedBytes())
+	}
+}
+
+func TestWritePastEnd(t *testing.T) {
+	const size = overlay.BlockSize + 100
+
+	b := overlay.New(bytes.NewReader(make([]byte, size)), size)
+
+	n, err := b.WriteAt([]byte{1, 2, 3, 4}, size-2)
+	if n != 2 || err != io.EOF {
+		t.Errorf("write: %d, %v", n, err)
+	}
+
+	result := make([]byte, 2)
+	if _, err := b.ReadAt(result, size-2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, []byte{1, 2}) {
+		t.Errorf("content: %v", result)
+	}
+
+	if n, err := b.WriteAt([]byte{1}, size); n != 0 || err != io.EOF {
+		t.Errorf("write at end: %d, %v", n, err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	const size = overlay.BlockSize
+
+	b := overlay.New(bytes.NewReader(make([]byte, size)), size)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.WriteAt(bytes.Repeat([]byte{byte(i)}, size), 0)
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			result := make([]byte, size)
+			for j := 0; j < 100; j++ {
+				if _, err := b.ReadAt(result, 0); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
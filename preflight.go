@@ -0,0 +1,235 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+)
+
+// Errors which can be matched with errors.Is.  The returned errors are
+// PreflightErrors with details.
+var (
+	ErrInvalidConfig         = errors.New("invalid configuration")
+	ErrFuseUnavailable       = errors.New("FUSE device is not available")
+	ErrFusermountUnavailable = errors.New("fusermount is not available")
+	ErrRuntimeDirUnavailable = errors.New("runtime directory is not available")
+	ErrMountpointPermission  = errors.New("mountpoint is not accessible")
+	ErrMountpointBusy        = errors.New("mountpoint is in use")
+	ErrFusectlUnavailable    = errors.New("fusectl filesystem is not mounted")
+	ErrMountFailed           = errors.New("mount failed")
+)
+
+// PreflightError describes a failed prerequisite.
+type PreflightError struct {
+	Err   error  // one of the Err* variables
+	Path  string // file or directory, if applicable
+	Cause error  // underlying error, if any
+	Hint  string // how to fix it
+}
+
+func (e *PreflightError) Error() string {
+	s := "lazymem: " + e.Err.Error()
+	if e.Path != "" {
+		s += ": " + e.Path
+	}
+	if e.Cause != nil {
+		s += ": " + e.Cause.Error()
+	}
+	if e.Hint != "" {
+		s += " (" + e.Hint + ")"
+	}
+	return s
+}
+
+func (e *PreflightError) Is(target error) bool { return target == e.Err }
+func (e *PreflightError) Unwrap() error        { return e.Cause }
+
+// Preflight checks the prerequisites of New without mounting anything.  The
+// first problem is returned as a PreflightError.  The mountpoint checks are
+// stricter than New: a non-empty directory or an existing mount point is
+// reported, even though the mount helper may accept it.
+func Preflight(ctx context.Context, config *Config) error {
+	var c Config
+	if config != nil {
+		c = *config
+	}
+
+	if err := c.validate(); err != nil {
+		return &PreflightError{Err: ErrInvalidConfig, Cause: err}
+	}
+
+	mountpoint := c.Mountpoint
+	if mountpoint == "" {
+		mountpoint = defaultMountpoint()
+	}
+
+	checks := []func() error{
+		checkFuseDevice,
+		checkFusermount,
+		func() error { return checkMountpoint(mountpoint, c.Mountpoint == "") },
+	}
+	if c.AbortOnShutdown {
+		checks = append(checks, checkFusectl)
+	}
+
+	for _, check := range checks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func defaultMountpoint() string {
+	return fmt.Sprintf("%s/lazymem/%d", runtimeDir(), os.Getpid())
+}
+
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return "/run"
+}
+
+func checkFuseDevice() error {
+	const filename = "/dev/fuse"
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err == nil {
+		f.Close()
+		return nil
+	}
+
+	hint := "load the fuse kernel module with modprobe fuse, or pass the device to the container"
+	if os.IsPermission(err) {
+		hint = "allow access to the device, e.g. via the container's device rules"
+	}
+
+	return &PreflightError{Err: ErrFuseUnavailable, Path: filename, Cause: unwrapPathError(err), Hint: hint}
+}
+
+// checkFusermount only checks that the helper exists.  Whether it can mount
+// as the current user depends on setuid bits, capabilities or user namespaces,
+// so the mount attempt is the authority on that.
+func checkFusermount() error {
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		return &PreflightError{Err: ErrFusermountUnavailable, Cause: err, Hint: "install the fuse package, or link fusermount3 as fusermount"}
+	}
+
+	return nil
+}
+
+func checkMountpoint(dir string, defaulted bool) error {
+	var st syscall.Stat_t
+
+	err := syscall.Stat(dir, &st)
+	switch {
+	case err == syscall.ENOENT:
+		return checkCreatable(dir, defaulted)
+
+	case err == syscall.ENOTCONN:
+		return mountpointBusy(dir, err)
+
+	case err != nil:
+		return mountpointError(dir, err)
+
+	case st.Mode&syscall.S_IFMT != syscall.S_IFDIR:
+		return &PreflightError{Err: ErrMountpointBusy, Path: dir, Cause: syscall.ENOTDIR, Hint: "remove the file or choose another mountpoint"}
+	}
+
+	var parent syscall.Stat_t
+
+	if err := syscall.Stat(path.Dir(dir), &parent); err == nil && parent.Dev != st.Dev {
+		return mountpointBusy(dir, nil)
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return mountpointError(dir, unwrapPathError(err))
+	}
+	defer f.Close()
+
+	if names, _ := f.Readdirnames(1); len(names) > 0 {
+		return &PreflightError{Err: ErrMountpointBusy, Path: dir, Hint: "the directory is not empty; choose another mountpoint"}
+	}
+
+	if err := syscall.Access(dir, 7 /* R_OK|W_OK|X_OK */); err != nil {
+		return mountpointError(dir, err)
+	}
+
+	return nil
+}
+
+// checkCreatable checks that the nearest existing ancestor is writable.
+func checkCreatable(dir string, defaulted bool) error {
+	for parent := path.Dir(dir); ; parent = path.Dir(parent) {
+		err := syscall.Access(parent, 3 /* W_OK|X_OK */)
+		if err == syscall.ENOENT && parent != "/" && parent != "." {
+			continue
+		}
+		if err != nil {
+			if defaulted {
+				return &PreflightError{Err: ErrRuntimeDirUnavailable, Path: runtimeDir(), Cause: err, Hint: "set XDG_RUNTIME_DIR or Config.Mountpoint"}
+			}
+			return mountpointError(parent, err)
+		}
+		return nil
+	}
+}
+
+func mountpointBusy(dir string, cause error) error {
+	return &PreflightError{Err: ErrMountpointBusy, Path: dir, Cause: cause, Hint: "something is mounted there; a stale mount can be removed with fusermount -u -z " + dir}
+}
+
+func mountpointError(dir string, err error) error {
+	return &PreflightError{Err: ErrMountpointPermission, Path: dir, Cause: err, Hint: "choose a mountpoint owned by the current user"}
+}
+
+func checkFusectl() error {
+	const dir = "/sys/fs/fuse/connections"
+
+	var st, parent syscall.Stat_t
+
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(path.Dir(dir), &parent) != nil || st.Dev == parent.Dev {
+		return &PreflightError{Err: ErrFusectlUnavailable, Path: dir, Hint: "mount -t fusectl none " + dir + ", or disable AbortOnShutdown"}
+	}
+
+	return nil
+}
+
+// diagnoseMount explains a fuse.Mount failure.  The mount error is always
+// included; a failed prerequisite is joined to it, so that both can be
+// matched with errors.Is.  The mountpoint is checked only after a failure,
+// because the checks are stricter than the mount helper.
+func diagnoseMount(dir string, err error) error {
+	checkDir := func() error { return checkMountpoint(dir, false) }
+
+	for _, check := range []func() error{checkFuseDevice, checkFusermount, checkDir} {
+		if e := check(); e != nil {
+			err = errors.Join(err, e)
+			break
+		}
+	}
+
+	return &PreflightError{Err: ErrMountFailed, Path: dir, Cause: err}
+}
+
+func unwrapPathError(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
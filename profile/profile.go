@@ -0,0 +1,218 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package profile records the order in which buffer content is first read
+// by consumers, so that later populations can fetch it in that order.
+package profile
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/internal/wrap"
+	"github.com/tsavola/lazymem/linear"
+)
+
+const header = "lazymem-profile 1"
+
+// Profile lists chunk indexes in the order of first access.
+type Profile struct {
+	ChunkSize int64
+	Order     []int64
+}
+
+// Range of buffer content.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Ranges covering a buffer of the given size: first the profiled chunks in
+// order, then the rest in ascending order.  Chunks beyond the size are
+// ignored.  An error is returned if the chunk size is not positive.
+func (p *Profile) Ranges(size int64) (ranges []Range, err error) {
+	if p.ChunkSize <= 0 {
+		err = fmt.Errorf("profile: invalid chunk size: %d", p.ChunkSize)
+		return
+	}
+
+	count := (size + p.ChunkSize - 1) / p.ChunkSize
+	seen := make(map[int64]bool)
+
+	add := func(i int64) {
+		if i < 0 || i >= count || seen[i] {
+			return
+		}
+		seen[i] = true
+
+		r := Range{i * p.ChunkSize, p.ChunkSize}
+		if r.Offset+r.Length > size {
+			r.Length = size - r.Offset
+		}
+		ranges = append(ranges, r)
+	}
+
+	for _, i := range p.Order {
+		add(i)
+	}
+	for i := int64(0); i < count; i++ {
+		add(i)
+	}
+	return
+}
+
+// WriteTo writes the profile in a line-oriented text format.
+func (p *Profile) WriteTo(w io.Writer) (n int64, err error) {
+	bw := bufio.NewWriter(w)
+
+	m, _ := fmt.Fprintf(bw, "%s %d\n", header, p.ChunkSize)
+	n += int64(m)
+
+	for _, i := range p.Order {
+		m, _ = fmt.Fprintf(bw, "%d\n", i)
+		n += int64(m)
+	}
+
+	err = bw.Flush()
+	return
+}
+
+// Read a profile written by WriteTo.
+func Read(r io.Reader) (p *Profile, err error) {
+	s := bufio.NewScanner(r)
+
+	if !s.Scan() {
+		err = s.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	line := s.Text()
+	if !strings.HasPrefix(line, header+" ") {
+		err = errors.New("profile: unknown format")
+		return
+	}
+
+	chunkSize, err := strconv.ParseInt(line[len(header)+1:], 10, 64)
+	if err != nil {
+		return
+	}
+	if chunkSize <= 0 {
+		err = fmt.Errorf("profile: invalid chunk size: %d", chunkSize)
+		return
+	}
+
+	p = &Profile{ChunkSize: chunkSize}
+
+	for s.Scan() {
+		var i int64
+
+		i, err = strconv.ParseInt(s.Text(), 10, 64)
+		if err != nil {
+			p = nil
+			return
+		}
+
+		p.Order = append(p.Order, i)
+	}
+
+	err = s.Err()
+	if err != nil {
+		p = nil
+	}
+	return
+}
+
+// Recorder wraps buffers and records the chunks read through them.
+type Recorder struct {
+	chunkSize int64
+
+	lock  sync.Mutex
+	seen  map[int64]bool
+	order []int64
+}
+
+// NewRecorder with a chunk size.  Zero means linear.BlockSize, which is
+// needed for profiles used with PopulateLinear.
+func NewRecorder(chunkSize int64) *Recorder {
+	if chunkSize <= 0 {
+		chunkSize = linear.BlockSize
+	}
+
+	return &Recorder{
+		chunkSize: chunkSize,
+		seen:      make(map[int64]bool),
+	}
+}
+
+// Profile recorded so far.
+func (r *Recorder) Profile() *Profile {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return &Profile{
+		ChunkSize: r.chunkSize,
+		Order:     append([]int64(nil), r.order...),
+	}
+}
+
+func (r *Recorder) record(offset int64, length int) {
+	if length <= 0 {
+		return
+	}
+
+	begin := offset / r.chunkSize
+	end := (offset + int64(length) + r.chunkSize - 1) / r.chunkSize
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := begin; i < end; i++ {
+		if !r.seen[i] {
+			r.seen[i] = true
+			r.order = append(r.order, i)
+		}
+	}
+}
+
+type recordingReader struct {
+	r   io.ReaderAt
+	rec *Recorder
+}
+
+func (x recordingReader) ReadAt(b []byte, offset int64) (int, error) {
+	return x.ReadAtContext(context.Background(), b, offset)
+}
+
+func (x recordingReader) ReadAtContext(ctx context.Context, b []byte, offset int64) (int, error) {
+	x.rec.record(offset, len(b))
+	return wrap.ReadAtContext(ctx, x.r, b, offset)
+}
+
+// Temporal wraps a TemporalBuffer.  The optional lazymem buffer interfaces
+// implemented by b are implemented by the wrapper too.
+func (r *Recorder) Temporal(b lazymem.TemporalBuffer) lazymem.TemporalBuffer {
+	return wrap.Buffer(b, recordingReader{b, r}, nil, nil).(lazymem.TemporalBuffer)
+}
+
+// Cloned wraps a ClonedBuffer.  The optional lazymem buffer interfaces
+// implemented by b are implemented by the wrapper too.
+func (r *Recorder) Cloned(b lazymem.ClonedBuffer) lazymem.ClonedBuffer {
+	return wrap.Buffer(b, recordingReader{b, r}, nil, b).(lazymem.ClonedBuffer)
+}
+
+// Shared wraps a SharedBuffer.  The optional lazymem buffer interfaces
+// implemented by b are implemented by the wrapper too.
+func (r *Recorder) Shared(b lazymem.SharedBuffer) lazymem.SharedBuffer {
+	return wrap.Buffer(b, recordingReader{b, r}, b, b).(lazymem.SharedBuffer)
+}
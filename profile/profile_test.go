@@ -0,0 +1,106 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package profile_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/tsavola/lazymem"
+	"github.com/tsavola/lazymem/linear"
+	"github.com/tsavola/lazymem/profile"
+	"github.com/tsavola/lazymem/sparse"
+)
+
+type source []byte
+
+func (s source) ReadAt(b []byte, offset int64) (int, error) { return copy(b, s[offset:]), nil }
+func (s source) Close() error                               { return nil }
+
+func TestRecordReplay(t *testing.T) {
+	const size = 5*linear.BlockSize + 1000
+
+	rec := profile.NewRecorder(0)
+	b := rec.Cloned(source(make([]byte, size)))
+
+	b.ReadAt(make([]byte, 100), 3*linear.BlockSize+10)
+	b.ReadAt(make([]byte, linear.BlockSize), linear.BlockSize/2)
+	b.ReadAt(make([]byte, 100), 3*linear.BlockSize)
+
+	var file bytes.Buffer
+
+	if _, err := rec.Profile().WriteTo(&file); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := profile.Read(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p.Order, []int64{3, 0, 1}) {
+		t.Fatal(p.Order)
+	}
+
+	buf := linear.NewBuffer(make([]byte, size))
+
+	var fetched []int64
+
+	err = profile.PopulateLinear(buf, p, func(dest []byte, offset int64) error {
+		fetched = append(fetched, offset/linear.BlockSize)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fetched, []int64{3, 0, 1, 2, 4, 5}) {
+		t.Error(fetched)
+	}
+
+	select {
+	case <-buf.Populated():
+	default:
+		t.Error("not populated")
+	}
+}
+
+func TestZeroChunkSize(t *testing.T) {
+	p := new(profile.Profile)
+
+	if _, err := p.Ranges(1000); err == nil {
+		t.Error("Ranges succeeded")
+	}
+
+	fetch := func([]byte, int64) error { return nil }
+
+	if err := profile.PopulateLinear(linear.NewBuffer(make([]byte, 1000)), p, fetch); err == nil {
+		t.Error("PopulateLinear succeeded")
+	}
+	if err := profile.ProduceSparse(sparse.NewBuffer(), 1000, p, fetch); err == nil {
+		t.Error("ProduceSparse succeeded")
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	buf := linear.NewBuffer(make([]byte, 3*linear.BlockSize))
+	buf.BlocksPopulated(0, 3)
+
+	rec := profile.NewRecorder(0)
+	b := rec.Cloned(buf)
+
+	if _, ok := b.(lazymem.PopulatedBuffer); !ok {
+		t.Error("PopulatedBuffer not forwarded")
+	}
+
+	if _, err := b.ReadAt(make([]byte, 100), 2*linear.BlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if order := rec.Profile().Order; !reflect.DeepEqual(order, []int64{2}) {
+		t.Error(order)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package profile
+
+import (
+	"fmt"
+
+	"github.com/tsavola/lazymem/linear"
+	"github.com/tsavola/lazymem/sparse"
+)
+
+// PopulateLinear fetches the buffer content in profiled order, marking
+// blocks populated as it goes.  The profile's chunk size must be a multiple
+// of linear.BlockSize.  PopulationFinished is called before returning.
+func PopulateLinear(buf *linear.Buffer, p *Profile, fetch func(dest []byte, offset int64) error) error {
+	defer buf.PopulationFinished()
+
+	if p.ChunkSize%linear.BlockSize != 0 {
+		return fmt.Errorf("profile: chunk size %d is not a multiple of block size", p.ChunkSize)
+	}
+
+	mem := buf.Bytes()
+
+	ranges, err := p.Ranges(int64(len(mem)))
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		if err := fetch(mem[r.Offset:r.Offset+r.Length], r.Offset); err != nil {
+			return err
+		}
+
+		index := int(r.Offset / linear.BlockSize)
+		count := int((r.Length + linear.BlockSize - 1) / linear.BlockSize)
+		buf.BlocksPopulated(index, count)
+	}
+
+	return nil
+}
+
+// ProduceSparse fetches size bytes of content in profiled order, producing a
+// frame per chunk.  ProductionFinished is called before returning.
+func ProduceSparse(buf *sparse.Buffer, size int64, p *Profile, fetch func(dest []byte, offset int64) error) error {
+	defer buf.ProductionFinished()
+
+	ranges, err := p.Ranges(size)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		data := make([]byte, r.Length)
+
+		if err := fetch(data, r.Offset); err != nil {
+			return err
+		}
+
+		buf.ProduceFrame(data, r.Offset)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/tsavola/lazymem/internal/memfd"
+)
+
+// PopulatedBuffer is a ClonedBuffer which can tell when all of its content
+// has become available.  linear.Buffer implements it.
+type PopulatedBuffer interface {
+	ClonedBuffer
+
+	// Populated channel is closed when all content is available.  It may
+	// also never be closed.
+	Populated() <-chan struct{}
+}
+
+// promotion of a fully populated buffer to a sealed memory file.
+type promotion struct {
+	source PopulatedBuffer
+	cancel chan struct{}
+
+	lock sync.Mutex
+	fd   int
+	done bool
+}
+
+func newPromotion(source PopulatedBuffer) *promotion {
+	return &promotion{
+		source: source,
+		cancel: make(chan struct{}),
+		fd:     -1,
+	}
+}
+
+// start waiting for the source to be populated.
+func (p *promotion) start(b buffer, errorLog Logger) {
+	go p.run(b, p.source.Populated(), errorLog)
+}
+
+func (p *promotion) run(b buffer, populated <-chan struct{}, errorLog Logger) {
+	select {
+	case <-populated:
+	case <-p.cancel:
+		return
+	}
+
+	fd, err := copyToMemfd(b)
+	if err != nil {
+		if errorLog != nil {
+			errorLog.Printf("lazymem: buffer promotion: %v", err)
+		}
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.done {
+		syscall.Close(fd)
+		return
+	}
+
+	p.fd = fd
+}
+
+// open the memory file, if the promotion has completed.
+func (p *promotion) open(mode int) (fd int, ok bool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.fd < 0 {
+		return
+	}
+
+	fd, err = syscall.Open(fmt.Sprintf("/proc/self/fd/%d", p.fd), mode, 0)
+	ok = true
+	return
+}
+
+func (p *promotion) forget() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.done {
+		return
+	}
+	p.done = true
+
+	close(p.cancel)
+
+	if p.fd >= 0 {
+		syscall.Close(p.fd)
+		p.fd = -1
+	}
+}
+
+func copyToMemfd(b buffer) (fd int, err error) {
+	fd, err = memfd.Create("lazymem", memfd.CLOEXEC|memfd.ALLOW_SEALING)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			syscall.Close(fd)
+			fd = -1
+		}
+	}()
+
+	err = syscall.Ftruncate(fd, b.size)
+	if err != nil {
+		return
+	}
+
+	data := make([]byte, statIoSize)
+
+	for offset := int64(0); offset < b.size; {
+		chunk := adjustLen(data, offset, b.size)
+
+		var n int
+
+		n, err = b.readAt(context.Background(), chunk, offset)
+		if n < len(chunk) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+
+		for len(chunk) > 0 {
+			n, err = syscall.Pwrite(fd, chunk, offset)
+			if err != nil {
+				return
+			}
+			if n == 0 {
+				err = io.ErrShortWrite
+				return
+			}
+
+			chunk = chunk[n:]
+			offset += int64(n)
+		}
+	}
+
+	err = memfd.AddSeals(fd, memfd.SEAL_SHRINK|memfd.SEAL_GROW|memfd.SEAL_WRITE|memfd.SEAL_SEAL)
+	return
+}
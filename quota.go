@@ -0,0 +1,69 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+// QuotaError is returned by Create, CreateCloned and CreateTemporal when a
+// Config limit would be exceeded.  It matches syscall.ENOSPC with errors.Is.
+type QuotaError struct {
+	Resource string // "pages" or "buffers"
+	Limit    uint64
+	Used     uint64 // before the failed allocation
+	Request  uint64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("lazymem: %s quota exceeded: %d+%d > %d", e.Resource, e.Used, e.Request, e.Limit)
+}
+
+func (e *QuotaError) Unwrap() error { return syscall.ENOSPC }
+
+// quota counter.  Zero limit means unlimited.
+type quota struct {
+	used  uint64 // atomic
+	limit uint64
+}
+
+func (q *quota) reserve(resource string, n uint64) error {
+	for {
+		used := atomic.LoadUint64(&q.used)
+
+		if q.limit > 0 && used+n > q.limit {
+			return &QuotaError{resource, q.limit, used, n}
+		}
+
+		if atomic.CompareAndSwapUint64(&q.used, used, used+n) {
+			return nil
+		}
+	}
+}
+
+func (q *quota) release(n uint64) {
+	atomic.AddUint64(&q.used, ^(n - 1))
+}
+
+func (q *quota) load() uint64 {
+	return atomic.LoadUint64(&q.used)
+}
+
+// stat returns the total and free counts.  Without a limit, the total is
+// the current usage and nothing is free.
+func (q *quota) stat() (total, free uint64) {
+	used := q.load()
+	if q.limit == 0 {
+		return used, 0
+	}
+
+	total = q.limit
+	if used < total {
+		free = total - used
+	}
+	return
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// ErrUnmounted is reported by Manager.Err when the filesystem has been
+// unmounted by someone else, or the FUSE connection has been aborted.
+var ErrUnmounted = errors.New("lazymem: filesystem was unmounted unexpectedly")
+
+// session of a mounted filesystem.
+type session struct {
+	fs    *fileSystem
+	mount *fuse.MountedFileSystem
+	dev   uint64
+	done  chan struct{}
+	err   error // valid after done is closed
+}
+
+func (m *Manager) mount(ctx context.Context) (s *session, err error) {
+	s = &session{
+		done: make(chan struct{}),
+	}
+
+	s.fs, err = newFileSystem(m.log, &m.Config)
+	if err != nil {
+		return
+	}
+
+	s.mount, err = fuse.Mount(m.Mountpoint, fuseutil.NewFileSystemServer(s.fs), m.Config.mountConfig(ctx))
+	if err != nil {
+		m.log.Error("mount failed", "mountpoint", m.Mountpoint, "error", err)
+		err = diagnoseMount(m.Mountpoint, err)
+		return
+	}
+
+	m.log.Info("mounted", "mountpoint", m.Mountpoint, LogKeyPid, os.Getpid())
+
+	var st syscall.Stat_t
+
+	err = syscall.Stat(m.Mountpoint, &st)
+	if err == nil {
+		s.dev = uint64(st.Dev)
+
+		if m.MaxReadahead > 0 {
+			err = setReadahead(s.dev, m.MaxReadahead)
+		}
+	}
+	if err != nil {
+		if fuse.Unmount(m.Mountpoint) == nil {
+			s.mount.Join(ctx)
+		}
+		return
+	}
+
+	go m.monitor(s)
+	return
+}
+
+func (m *Manager) monitor(s *session) {
+	err := s.mount.Join(context.Background())
+
+	m.lock.Lock()
+	closing := m.closing
+	m.lock.Unlock()
+
+	if err == nil {
+		if closing {
+			err = ErrShutdown
+		} else {
+			err = ErrUnmounted
+		}
+	}
+
+	if err != ErrShutdown {
+		m.log.Error("filesystem server exited", "mountpoint", m.Mountpoint, "error", err)
+	}
+
+	// Nobody is going to receive replies to pending reads.
+	s.fs.fail()
+
+	s.err = err
+	close(s.done)
+}
+
+func (m *Manager) current() *session {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.s
+}
+
+// active session for creating buffers.  The filesystem is remounted if
+// necessary and allowed.
+func (m *Manager) active() (s *session, err error) {
+	s, closing := m.state()
+
+	select {
+	case <-s.done:
+	default:
+		return
+	}
+
+	if closing || !m.Remount {
+		err = s.err
+		return
+	}
+
+	return m.remount(s)
+}
+
+func (m *Manager) state() (s *session, closing bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.s, m.closing
+}
+
+// remount replaces a dead session.  Unmounting and mounting may execute
+// fusermount, so m.lock isn't held meanwhile.
+func (m *Manager) remount(dead *session) (s *session, err error) {
+	m.remountLock.Lock()
+	defer m.remountLock.Unlock()
+
+	s, closing := m.state()
+	if s != dead {
+		return // remounted by another caller
+	}
+	if closing {
+		err = s.err
+		return
+	}
+
+	// The mountpoint may still be occupied by an aborted connection.
+	lazyUnmount(m.Mountpoint)
+
+	m.log.Info("remounting", "mountpoint", m.Mountpoint, "error", s.err)
+
+	// The context passed to New may have been canceled since.
+	s, err = m.mount(context.WithoutCancel(m.ctx))
+	if err != nil {
+		return
+	}
+
+	m.lock.Lock()
+	closing = m.closing
+	if !closing {
+		m.s = s
+	}
+	m.lock.Unlock()
+
+	if closing {
+		// Shutdown was called while mounting.
+		if m.unmount(s) == nil {
+			<-s.done
+		}
+		s = nil
+		err = ErrShutdown
+	}
+	return
+}
+
+// Done channel is closed when the filesystem server exits.  After
+// remounting, Done returns a new channel.
+func (m *Manager) Done() <-chan struct{} {
+	return m.current().done
+}
+
+// Err returns nil until Done is closed.  Then it returns ErrShutdown if the
+// filesystem was unmounted by Shutdown, ErrUnmounted if it was unmounted by
+// someone else, or the error which caused the server to exit.
+func (m *Manager) Err() error {
+	s := m.current()
+
+	select {
+	case <-s.done:
+		return s.err
+
+	default:
+		return nil
+	}
+}
+
+// Ping checks that the filesystem is mounted and responding.
+func (m *Manager) Ping(ctx context.Context) error {
+	s := m.current()
+
+	select {
+	case <-s.done:
+		return s.err
+
+	default:
+	}
+
+	result := make(chan error, 1)
+
+	go func() {
+		var st syscall.Stat_t
+
+		err := syscall.Stat(m.Mountpoint, &st)
+		if err == nil && uint64(st.Dev) != s.dev {
+			err = ErrUnmounted
+		}
+		if err == nil {
+			// Attributes may be cached, but statfs always reaches the
+			// server.
+			var fsst syscall.Statfs_t
+			err = syscall.Statfs(m.Mountpoint, &fsst)
+		}
+
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+// ErrShutdown is returned when creating buffers after Shutdown has been
+// called.
+var ErrShutdown = errors.New("lazymem: manager is shutting down")
+
+// ShutdownOutcome describes how the filesystem was unmounted.
+type ShutdownOutcome int
+
+const (
+	// ShutdownFailed means that the filesystem is still mounted.
+	ShutdownFailed ShutdownOutcome = iota
+
+	// ShutdownClean means that all buffers were released before unmounting.
+	ShutdownClean
+
+	// ShutdownDetached means that the filesystem was lazily unmounted while
+	// buffers were in use.  They fail with EIO, and the server keeps running
+	// in the background until they are released.
+	ShutdownDetached
+
+	// ShutdownForced means that the FUSE connection was aborted after
+	// detaching.  Pending and future accesses of the buffers fail.
+	ShutdownForced
+
+	// ShutdownUnmounted means that the filesystem server had already exited,
+	// e.g. because someone else unmounted the filesystem (see Manager.Err).
+	// Buffers which are still in use fail.
+	ShutdownUnmounted
+)
+
+func (o ShutdownOutcome) String() string {
+	switch o {
+	case ShutdownFailed:
+		return "failed"
+
+	case ShutdownClean:
+		return "clean"
+
+	case ShutdownDetached:
+		return "detached"
+
+	case ShutdownForced:
+		return "forced"
+
+	case ShutdownUnmounted:
+		return "unmounted"
+
+	default:
+		return fmt.Sprintf("ShutdownOutcome(%d)", int(o))
+	}
+}
+
+const drainPollInterval = 10 * time.Millisecond
+
+// Shutdown is like Drain, without reporting the outcome.  It waits until all
+// buffers have been released or the context is done.
+func (m *Manager) Shutdown(ctx context.Context) (err error) {
+	_, err = m.Drain(ctx)
+	return
+}
+
+// Drain stops buffer creation, waits until all buffers have been released or
+// the context is done, and unmounts the filesystem.  If buffers are still in
+// use, the outcome depends on Config.DetachOnShutdown and
+// Config.AbortOnShutdown.  Reads which are waiting for content are failed
+// when the filesystem is detached.
+//
+// If the outcome is ShutdownFailed, buffers can be created again, and Drain
+// or Shutdown may be retried.
+func (m *Manager) Drain(ctx context.Context) (outcome ShutdownOutcome, err error) {
+	m.lock.Lock()
+	m.closing = true
+	s := m.s
+	m.lock.Unlock()
+
+	s.fs.shutdown()
+
+	select {
+	case <-s.done:
+		err = m.cleanup()
+		outcome = ShutdownUnmounted
+		return
+
+	default:
+	}
+
+	live := s.fs.waitForRelease(ctx, drainPollInterval)
+	if live == 0 {
+		err = m.unmount(s)
+		if err == nil {
+			err = m.join(ctx, s)
+			outcome = ShutdownClean
+			return
+		}
+
+		live = s.fs.buffers.load()
+	}
+
+	if !m.DetachOnShutdown {
+		if err == nil {
+			err = fmt.Errorf("lazymem: %d buffers still in use: %w", live, ctx.Err())
+		}
+		m.resume(s)
+		return
+	}
+
+	err = lazyUnmount(s.mount.Dir())
+	if err != nil {
+		m.log.Error("lazy unmount failed", "mountpoint", m.Mountpoint, "error", err)
+		m.resume(s)
+		return
+	}
+
+	m.log.Warn("failing buffers still in use", "buffers", live)
+	s.fs.fail()
+
+	outcome = ShutdownDetached
+	m.log.Info("detached", "mountpoint", m.Mountpoint, LogKeyPid, os.Getpid())
+
+	if m.AbortOnShutdown {
+		err = abortConnection(s.dev)
+		if err != nil {
+			m.log.Error("connection abort failed", "error", err)
+		} else {
+			outcome = ShutdownForced
+			m.log.Info("connection aborted", "mountpoint", m.Mountpoint)
+
+			<-s.done
+		}
+	}
+
+	if e := m.cleanup(); err == nil {
+		err = e
+	}
+	return
+}
+
+// resume buffer creation after a failed shutdown.
+func (m *Manager) resume(s *session) {
+	m.lock.Lock()
+	m.closing = false
+	m.lock.Unlock()
+
+	s.fs.resume()
+}
+
+func (m *Manager) unmount(s *session) (err error) {
+	err = fuse.Unmount(s.mount.Dir())
+	if err != nil {
+		m.log.Error("unmount failed", "mountpoint", m.Mountpoint, "error", err)
+	} else {
+		m.log.Info("unmounted", "mountpoint", m.Mountpoint, LogKeyPid, os.Getpid())
+	}
+	return
+}
+
+func (m *Manager) join(ctx context.Context, s *session) (err error) {
+	select {
+	case <-s.done:
+		if s.err != ErrShutdown {
+			err = s.err
+		}
+
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if e := m.cleanup(); err == nil {
+		err = e
+	}
+	return
+}
+
+// lazyUnmount detaches the filesystem from the mount namespace.  It can be
+// accessed via existing file descriptors and mappings.
+func lazyUnmount(dir string) error {
+	err := syscall.Unmount(dir, syscall.MNT_DETACH)
+	if err == syscall.EPERM {
+		if out, e := exec.Command("fusermount", "-u", "-z", dir).CombinedOutput(); e != nil {
+			return fmt.Errorf("fusermount: %v: %s", e, out)
+		}
+		err = nil
+	}
+	return err
+}
+
+// abortConnection via the fusectl filesystem.
+func abortConnection(dev uint64) error {
+	major := (dev >> 8) & 0xfff
+	minor := (dev & 0xff) | ((dev >> 12) & 0xfff00)
+
+	filename := fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", major<<20|minor)
+	return ioutil.WriteFile(filename, []byte("1"), 0)
+}
@@ -6,7 +6,9 @@
 package sparse
 
 import (
+	"context"
 	"io"
+	"runtime/trace"
 	"sort"
 	"sync"
 )
@@ -36,13 +38,20 @@ func (b *Buffer) searchForFrame(offset int64) int {
 }
 
 func (b *Buffer) ReadAt(dest []byte, offset int64) (int, error) {
+	return b.ReadAtContext(context.Background(), dest, offset)
+}
+
+// ReadAtContext is like ReadAt.  If the read has to wait for a frame, the
+// wait is traced as a region of the context's runtime/trace task, and it's
+// interrupted with the context's error when the context is done.
+func (b *Buffer) ReadAtContext(ctx context.Context, dest []byte, offset int64) (int, error) {
 	var copied int
 
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
 	for len(dest) > 0 {
-		data, err := b.getData(offset, len(dest))
+		data, err := b.getData(ctx, offset, len(dest))
 		if err != nil {
 			return copied, err
 		}
@@ -57,7 +66,20 @@ func (b *Buffer) ReadAt(dest []byte, offset int64) (int, error) {
 }
 
 // getData must be called with b.lock held.
-func (b *Buffer) getData(offset int64, length int) ([]byte, error) {
+func (b *Buffer) getData(ctx context.Context, offset int64, length int) ([]byte, error) {
+	var (
+		region *trace.Region
+		stop   func() bool
+	)
+	defer func() {
+		if region != nil {
+			region.End()
+		}
+		if stop != nil {
+			stop()
+		}
+	}()
+
 	for {
 		i := b.searchForFrame(offset)
 		if i < len(b.frames) {
@@ -77,10 +99,30 @@ func (b *Buffer) getData(offset int64, length int) ([]byte, error) {
 			return nil, io.EOF
 		}
 
+		if region == nil {
+			region = trace.StartRegion(ctx, "sparse.getData")
+			if trace.IsEnabled() {
+				trace.Logf(ctx, "offset", "%d", offset)
+			}
+
+			stop = context.AfterFunc(ctx, b.wake)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		b.cond.Wait()
 	}
 }
 
+func (b *Buffer) wake() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.cond.Broadcast()
+}
+
 // sliceFrame must be called with b.lock held.
 func (b *Buffer) sliceFrame(i int, f *frame, o, resultLength int) (result []byte) {
 	result = f.data[o:]
@@ -0,0 +1,51 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"runtime/trace"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// traceOp starts a runtime/trace task and region for a filesystem op.  The
+// FUSE binding doesn't expose the calling process id, so it can't be
+// included.
+func traceOp(ctx context.Context, name string, inode fuseops.InodeID) (context.Context, *trace.Task, *trace.Region) {
+	ctx, task, region := startTrace(ctx, name)
+	traceInode(ctx, inode)
+	return ctx, task, region
+}
+
+// startTrace is like traceOp, for ops which have to resolve the inode first.
+func startTrace(ctx context.Context, name string) (context.Context, *trace.Task, *trace.Region) {
+	ctx, task := trace.NewTask(ctx, name)
+	return ctx, task, trace.StartRegion(ctx, name)
+}
+
+func traceInode(ctx context.Context, inode fuseops.InodeID) {
+	if trace.IsEnabled() {
+		trace.Logf(ctx, "inode", "%d", inode)
+	}
+}
+
+func endTrace(task *trace.Task, region *trace.Region) {
+	region.End()
+	task.End()
+}
+
+func traceRange(ctx context.Context, offset int64, length int) {
+	if trace.IsEnabled() {
+		trace.Logf(ctx, "offset", "%d", offset)
+		trace.Logf(ctx, "length", "%d", length)
+	}
+}
+
+func traceError(ctx context.Context, err error) {
+	if err != nil && trace.IsEnabled() {
+		trace.Log(ctx, "error", err.Error())
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2018 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lazymem
+
+import (
+	"context"
+	"syscall"
+)
+
+// CreateView of a range of a buffer created with Create or CreateCloned (or
+// another view).  The new file descriptor has its own access mode, and offset
+// zero corresponds to the offset in the buffer.  Reads and writes are
+// translated to the buffer; population state is shared and nothing is
+// copied.  The buffer is not closed before the view has been released.
+//
+// The view has its own page cache, so writes made via shared mappings of the
+// view and the buffer don't become visible to each other until they have
+// been written back.
+func (m *Manager) CreateView(fd int, offset, length int64, mode int) (viewFd int, err error) {
+	s, id, b, err := m.lookupFd(fd)
+	if err != nil {
+		return
+	}
+
+	if b.kind == kindTemporal || offset < 0 || length < 0 || offset > b.size || length > b.size-offset {
+		err = syscall.EINVAL
+		return
+	}
+
+	parent := s.fs.holdNode(id)
+	if parent == nil {
+		err = syscall.EBADF
+		return
+	}
+
+	release := func() error {
+		return s.fs.releaseNode(context.Background(), id, parent)
+	}
+
+	v := buffer{
+		kind: b.kind,
+		size: length,
+		readAt: func(ctx context.Context, target []byte, sourceOffset int64) (int, error) {
+			return b.readAt(ctx, target, offset+sourceOffset)
+		},
+		writeAt: func(source []byte, targetOffset int64) (int, error) {
+			return b.writeAt(source, offset+targetOffset)
+		},
+		close: release,
+		view:  true,
+	}
+
+	viewFd, err = m.createIn(s, v, mode)
+	if err != nil {
+		release()
+	}
+	return
+}